@@ -0,0 +1,330 @@
+// Package client is a Go client for the HTTP API of the fiotuf agent. The
+// API is described in openapi.yaml.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// DefaultAddress is the address the agent listens at by default
+const DefaultAddress = "127.0.0.1:9080"
+
+// Client talks to a fiotuf agent
+type Client struct {
+	baseUrl string
+	token   string
+	http    *http.Client
+}
+
+// New creates a client for the agent listening at address, either a TCP
+// address like "127.0.0.1:9080", a URL, or a unix socket like
+// "unix:/run/fiotuf/api.sock". If token is set, it is sent as a bearer token.
+func New(address string, token string) (*Client, error) {
+	c := &Client{token: token, http: &http.Client{}}
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		c.baseUrl = "http://fiotuf"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return c, nil
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent address: %w", err)
+	}
+	c.baseUrl = strings.TrimSuffix(u.String(), "/")
+	return c, nil
+}
+
+// Error is returned for requests the agent did not complete successfully.
+// TUF failures unwrap to a *tuf.Error, so that errors.Is(err, tuf.ErrExpired)
+// and the like work.
+type Error struct {
+	StatusCode int
+	Message    string
+	Kind       tuf.ErrorKind
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("fiotuf agent returned %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	if e.Kind == "" {
+		return nil
+	}
+	return &tuf.Error{Kind: e.Kind, Err: errors.New(e.Message)}
+}
+
+// JobState is the state of a refresh job. While running, it is the phase of
+// the refresh, like tuf.PhaseSnapshot.
+type JobState string
+
+const (
+	JobQueued JobState = "queued"
+	JobDone   JobState = "done"
+	JobFailed JobState = "failed"
+)
+
+// Job is a refresh requested through the API
+type Job struct {
+	ID              string        `json:"id"`
+	Source          string        `json:"source,omitempty"`
+	State           JobState      `json:"state"`
+	Created         time.Time     `json:"created"`
+	Started         *time.Time    `json:"started,omitempty"`
+	Finished        *time.Time    `json:"finished,omitempty"`
+	BytesDownloaded int64         `json:"bytesDownloaded"`
+	Error           string        `json:"error,omitempty"`
+	ErrorKind       tuf.ErrorKind `json:"errorKind,omitempty"`
+}
+
+// IsFinished tells if the job is done or failed
+func (j *Job) IsFinished() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// HealthCheck is the outcome of one of the readiness checks
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Health is returned by the health and readiness endpoints
+type Health struct {
+	// Status is "ok" or "failing"
+	Status  string        `json:"status"`
+	Started time.Time     `json:"started"`
+	Version string        `json:"version,omitempty"`
+	Checks  []HealthCheck `json:"checks,omitempty"`
+}
+
+// TargetsOptions selects the targets returned by GetTargets
+type TargetsOptions struct {
+	// Filtered only keeps the targets matching the device tags and hardware ID
+	Filtered bool
+	// HardwareId only keeps the targets for the given hardware
+	HardwareId string
+}
+
+func (o *TargetsOptions) query() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Filtered {
+		q.Set("filtered", "true")
+	}
+	if o.HardwareId != "" {
+		q.Set("hardwareId", o.HardwareId)
+	}
+	return q
+}
+
+// GetTargets returns the latest targets list
+func (c *Client) GetTargets(ctx context.Context, opts *TargetsOptions) (map[string]*metadata.TargetFiles, error) {
+	var ret map[string]*metadata.TargetFiles
+	return ret, c.getJSON(ctx, "/targets", opts.query(), &ret)
+}
+
+// GetDelegatedTargets returns the latest targets list, with the role that
+// provided each target
+func (c *Client) GetDelegatedTargets(ctx context.Context, opts *TargetsOptions) (map[string]*tuf.DelegatedTarget, error) {
+	q := opts.query()
+	q.Set("provenance", "true")
+	var ret map[string]*tuf.DelegatedTarget
+	return ret, c.getJSON(ctx, "/targets", q, &ret)
+}
+
+// GetRoot returns the trusted root metadata
+func (c *Client) GetRoot(ctx context.Context) (*metadata.Metadata[metadata.RootType], error) {
+	data, err := c.getRaw(ctx, "/root", nil)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Root().FromBytes(data)
+}
+
+// Refresh refreshes the TUF metadata from the device gateway, or from
+// localTufRepo if set, and waits for it to finish. Failures are returned as
+// an *Error.
+func (c *Client) Refresh(ctx context.Context, localTufRepo string) (*Job, error) {
+	var job Job
+	return &job, c.do(ctx, http.MethodPost, "/targets/update/", refreshQuery(localTufRepo, false), &job)
+}
+
+// SubmitRefresh queues a refresh and returns without waiting for it, use
+// GetJob to follow it
+func (c *Client) SubmitRefresh(ctx context.Context, localTufRepo string) (*Job, error) {
+	var job Job
+	return &job, c.do(ctx, http.MethodPost, "/targets/update/", refreshQuery(localTufRepo, true), &job)
+}
+
+func refreshQuery(localTufRepo string, async bool) url.Values {
+	q := url.Values{}
+	if localTufRepo != "" {
+		q.Set("localTufRepo", localTufRepo)
+	}
+	if async {
+		q.Set("async", "true")
+	}
+	return q
+}
+
+// GetJob returns a refresh job
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	return &job, c.getJSON(ctx, "/jobs/"+url.PathEscape(id), nil, &job)
+}
+
+// ListJobs returns the last refresh jobs, most recent first
+func (c *Client) ListJobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	return jobs, c.getJSON(ctx, "/jobs", nil, &jobs)
+}
+
+// GetRefreshStatus returns the outcome of the last refreshes
+func (c *Client) GetRefreshStatus(ctx context.Context) (*tuf.RefreshStatus, error) {
+	var status tuf.RefreshStatus
+	return &status, c.getJSON(ctx, "/targets/update/status", nil, &status)
+}
+
+// GetMetadataExpiry returns the expiration of every trusted role
+func (c *Client) GetMetadataExpiry(ctx context.Context) ([]tuf.RoleExpiry, error) {
+	var ret []tuf.RoleExpiry
+	return ret, c.getJSON(ctx, "/metadata/expiry", nil, &ret)
+}
+
+// GetMetadata returns the signed metadata of a role, as it was verified
+func (c *Client) GetMetadata(ctx context.Context, role string) ([]byte, error) {
+	return c.getRaw(ctx, "/metadata/"+url.PathEscape(role), nil)
+}
+
+// GetRootVersion returns a version of the root metadata trusted by the device
+func (c *Client) GetRootVersion(ctx context.Context, version int64) ([]byte, error) {
+	return c.getRaw(ctx, "/metadata/root/"+strconv.FormatInt(version, 10), nil)
+}
+
+// GetRootHistory returns the root versions trusted by the device
+func (c *Client) GetRootHistory(ctx context.Context) ([]tuf.RootInfo, error) {
+	var ret []tuf.RootInfo
+	return ret, c.getJSON(ctx, "/metadata/roots", nil, &ret)
+}
+
+// VerifyBundle verifies an offline update bundle without applying it
+func (c *Client) VerifyBundle(ctx context.Context, bundlePath string) (*tuf.BundleReport, error) {
+	var report tuf.BundleReport
+	return &report, c.do(ctx, http.MethodPost, "/bundles/verify", url.Values{"path": {bundlePath}}, &report)
+}
+
+// Health tells whether the agent is running
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	return &health, c.getJSON(ctx, "/healthz", nil, &health)
+}
+
+// Ready returns the readiness checks of the agent. An agent that is not
+// ready is not an error, check the returned Status.
+func (c *Client) Ready(ctx context.Context) (*Health, error) {
+	res, err := c.request(ctx, http.MethodGet, "/readyz", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusServiceUnavailable {
+		return nil, readError(res)
+	}
+	var health Health
+	if err = json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return nil, fmt.Errorf("invalid response from fiotuf agent: %w", err)
+	}
+	return &health, nil
+}
+
+// GetMetrics returns the metrics of the agent, in the Prometheus text format
+func (c *Client) GetMetrics(ctx context.Context) (string, error) {
+	data, err := c.getRaw(ctx, "/metrics", nil)
+	return string(data), err
+}
+
+func (c *Client) request(ctx context.Context, method string, path string, query url.Values) (*http.Response, error) {
+	u := c.baseUrl + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, out any) error {
+	res, err := c.request(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return readError(res)
+	}
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from fiotuf agent: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out any) error {
+	return c.do(ctx, http.MethodGet, path, query, out)
+}
+
+func (c *Client) getRaw(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	res, err := c.request(ctx, http.MethodGet, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// readError builds an *Error from the JSON error body of a failed request
+func readError(res *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	ret := &Error{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+	var body struct {
+		Error string        `json:"error"`
+		Kind  tuf.ErrorKind `json:"kind"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), &body); err == nil && body.Error != "" {
+		ret.Message = body.Error
+		ret.Kind = body.Kind
+	}
+	return ret
+}
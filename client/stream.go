@@ -0,0 +1,117 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foundriesio/fiotuf/tuf"
+)
+
+// StreamEventType is the type of the events of the agent event stream
+type StreamEventType string
+
+const (
+	// EventRefreshProgress data is a tuf.RefreshProgress
+	EventRefreshProgress StreamEventType = "refresh-progress"
+	// EventRefreshFinished data is a tuf.RefreshResult
+	EventRefreshFinished StreamEventType = "refresh-finished"
+	// EventTargetsAvailable data is a TargetsAvailable
+	EventTargetsAvailable StreamEventType = "targets-available"
+	// EventUpdateProgress data is an UpdateProgress
+	EventUpdateProgress StreamEventType = "update-progress"
+)
+
+// StreamEvent is an event of the agent event stream. Its data is decoded
+// with the Decode* methods matching its type.
+type StreamEvent struct {
+	Type StreamEventType `json:"type"`
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// TargetsAvailable lists targets this device may update to that are new
+// since the agent started
+type TargetsAvailable struct {
+	Targets []string `json:"targets"`
+}
+
+// UpdateProgress reports the progress of an update run by the agent
+type UpdateProgress struct {
+	Target  string `json:"target"`
+	Stage   string `json:"stage"`
+	App     string `json:"app,omitempty"`
+	Image   string `json:"image,omitempty"`
+	Layer   string `json:"layer,omitempty"`
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+// DecodeRefreshProgress decodes the data of an EventRefreshProgress event
+func (e *StreamEvent) DecodeRefreshProgress() (*tuf.RefreshProgress, error) {
+	var ret tuf.RefreshProgress
+	return &ret, json.Unmarshal(e.Data, &ret)
+}
+
+// DecodeRefreshFinished decodes the data of an EventRefreshFinished event
+func (e *StreamEvent) DecodeRefreshFinished() (*tuf.RefreshResult, error) {
+	var ret tuf.RefreshResult
+	return &ret, json.Unmarshal(e.Data, &ret)
+}
+
+// DecodeTargetsAvailable decodes the data of an EventTargetsAvailable event
+func (e *StreamEvent) DecodeTargetsAvailable() (*TargetsAvailable, error) {
+	var ret TargetsAvailable
+	return &ret, json.Unmarshal(e.Data, &ret)
+}
+
+// DecodeUpdateProgress decodes the data of an EventUpdateProgress event
+func (e *StreamEvent) DecodeUpdateProgress() (*UpdateProgress, error) {
+	var ret UpdateProgress
+	return &ret, json.Unmarshal(e.Data, &ret)
+}
+
+// StreamEvents calls fn with the events of the agent, starting with the last
+// event of each type, until ctx is done, the agent closes the stream or fn
+// returns an error
+func (c *Client) StreamEvents(ctx context.Context, fn func(StreamEvent) error) error {
+	res, err := c.request(ctx, http.MethodGet, "/events/stream", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(value)
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			// event names are repeated in the data, comments are keep-alives
+			continue
+		}
+		var evt StreamEvent
+		if err = json.Unmarshal([]byte(data.String()), &evt); err != nil {
+			return fmt.Errorf("invalid event from fiotuf agent: %w", err)
+		}
+		data.Reset()
+		if err = fn(evt); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
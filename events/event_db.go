@@ -100,3 +100,17 @@ func GetEvents(dbFilePath string) ([]DgUpdateEvent, int, error) {
 
 	return eventsList, maxId, nil
 }
+
+func CountEvents(dbFilePath string) (int, error) {
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM report_events;").Scan(&count); err != nil {
+		return -1, fmt.Errorf("failed to count events: %v", err)
+	}
+	return count, nil
+}
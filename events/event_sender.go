@@ -21,6 +21,9 @@ const (
 	InstallationStarted   EventTypeValue = "EcuInstallationStarted"
 	InstallationApplied   EventTypeValue = "EcuInstallationApplied"
 	InstallationCompleted EventTypeValue = "EcuInstallationCompleted"
+	MetadataExpiring      EventTypeValue = "TufMetadataExpiring"
+	MetadataUpdateFailed  EventTypeValue = "TufMetadataUpdateFailed"
+	NoCompatibleTarget    EventTypeValue = "NoCompatibleTarget"
 )
 
 type DgEvent struct {
@@ -29,6 +32,8 @@ type DgEvent struct {
 	TargetName    string `json:"targetName"`
 	Version       string `json:"version"`
 	Details       string `json:"details,omitempty"`
+	// ErrorKind classifies failures, see tuf.ErrorKind
+	ErrorKind string `json:"errorKind,omitempty"`
 }
 type DgEventType struct {
 	Id      EventTypeValue `json:"id"`
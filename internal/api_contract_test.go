@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/client"
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// TestClientContract runs every method of client.Client against the router
+// of an agent, so that the client and the handlers can't drift apart
+func TestClientContract(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	repo.AddTarget("test-1", 1, "test-hwid", "main")
+	repo.AddTarget("other-1", 1, "other-hwid", "main")
+	_, server := newTestAgent(t, repo, newTestGateway(t, repo).URL)
+	c, err := client.New(server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	health, err := c.Health(ctx)
+	if err != nil || health.Status != "ok" {
+		t.Errorf("Health: %+v, %v", health, err)
+	}
+	if _, err = c.Ready(ctx); err != nil {
+		t.Errorf("Ready: %v", err)
+	}
+
+	job, err := c.Refresh(ctx, "")
+	if err != nil || job.State != client.JobDone {
+		t.Fatalf("Refresh: %+v, %v", job, err)
+	}
+	job, err = c.SubmitRefresh(ctx, repo.MetadataDir())
+	if err != nil || job.ID == "" || job.Source != repo.MetadataDir() {
+		t.Fatalf("SubmitRefresh: %+v, %v", job, err)
+	}
+	for !job.IsFinished() {
+		time.Sleep(10 * time.Millisecond)
+		if job, err = c.GetJob(ctx, job.ID); err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+	}
+	if job.State != client.JobDone {
+		t.Errorf("expected the job to be done, got %+v", job)
+	}
+	_, err = c.GetJob(ctx, "unknown")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("GetJob: expected a 404 for an unknown job, got %v", err)
+	}
+	jobs, err := c.ListJobs(ctx)
+	if err != nil || len(jobs) != 2 || jobs[0].ID != job.ID {
+		t.Errorf("ListJobs: %+v, %v", jobs, err)
+	}
+	status, err := c.GetRefreshStatus(ctx)
+	if err != nil || status.LastSuccess == nil {
+		t.Errorf("GetRefreshStatus: %+v, %v", status, err)
+	}
+
+	targets, err := c.GetTargets(ctx, nil)
+	if err != nil || len(targets) != 2 {
+		t.Errorf("GetTargets: %v, %v", targets, err)
+	}
+	targets, err = c.GetTargets(ctx, &client.TargetsOptions{Filtered: true})
+	if _, ok := targets["test-1"]; err != nil || !ok || len(targets) != 1 {
+		t.Errorf("GetTargets filtered: %v, %v", targets, err)
+	}
+	targets, err = c.GetTargets(ctx, &client.TargetsOptions{HardwareId: "other-hwid"})
+	if _, ok := targets["other-1"]; err != nil || !ok || len(targets) != 1 {
+		t.Errorf("GetTargets by hardware ID: %v, %v", targets, err)
+	}
+	delegated, err := c.GetDelegatedTargets(ctx, nil)
+	if err != nil || len(delegated) != 2 || delegated["test-1"].Role != metadata.TARGETS {
+		t.Errorf("GetDelegatedTargets: %v, %v", delegated, err)
+	}
+
+	root, err := c.GetRoot(ctx)
+	if err != nil || root.Signed.Version != 1 {
+		t.Errorf("GetRoot: %v", err)
+	}
+	data, err := c.GetRootVersion(ctx, 1)
+	if err != nil || string(data) != string(repo.RootBytes()) {
+		t.Errorf("GetRootVersion: %v", err)
+	}
+	history, err := c.GetRootHistory(ctx)
+	if err != nil || len(history) != 1 {
+		t.Errorf("GetRootHistory: %+v, %v", history, err)
+	}
+	data, err = c.GetMetadata(ctx, metadata.TARGETS)
+	if err != nil {
+		t.Errorf("GetMetadata: %v", err)
+	} else if _, err = metadata.Targets().FromBytes(data); err != nil {
+		t.Errorf("GetMetadata: invalid targets metadata: %v", err)
+	}
+	expiry, err := c.GetMetadataExpiry(ctx)
+	if err != nil || len(expiry) != 4 {
+		t.Errorf("GetMetadataExpiry: %+v, %v", expiry, err)
+	}
+
+	report, err := c.VerifyBundle(ctx, repo.Dir)
+	if err != nil || !report.Valid {
+		t.Errorf("VerifyBundle: %+v, %v", report, err)
+	}
+	_, err = c.VerifyBundle(ctx, t.TempDir())
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("VerifyBundle: expected a 400 for an invalid bundle, got %v", err)
+	}
+
+	metricsText, err := c.GetMetrics(ctx)
+	if err != nil || metricsText == "" {
+		t.Errorf("GetMetrics: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	err = c.StreamEvents(ctx, func(evt client.StreamEvent) error {
+		if evt.Type != client.EventRefreshFinished {
+			return nil
+		}
+		if result, err := evt.DecodeRefreshFinished(); err != nil || result.Error != "" {
+			t.Errorf("StreamEvents: %+v, %v", result, err)
+		}
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("StreamEvents: expected the last refresh to be streamed, got %v", err)
+	}
+}
+
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions, http.MethodTrace,
+}
+
+// TestOpenApiRoutes checks that the routes of the agent are the ones
+// documented in client/openapi.yaml
+func TestOpenApiRoutes(t *testing.T) {
+	data, err := os.ReadFile("../client/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]any `yaml:"paths"`
+	}
+	if err = yaml.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	var documented []string
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			// path items may also hold parameters, summary and the like
+			if method = strings.ToUpper(method); slices.Contains(httpMethods, method) {
+				documented = append(documented, method+" "+path)
+			}
+		}
+	}
+
+	repo := tuftest.NewRepo(t)
+	a, _ := newTestAgent(t, repo, newTestGateway(t, repo).URL)
+	router, err := newRouter(a, &apiAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for _, route := range router.Routes() {
+		parts := strings.Split(route.Path, "/")
+		for i, part := range parts {
+			if name, ok := strings.CutPrefix(part, ":"); ok {
+				parts[i] = "{" + name + "}"
+			}
+		}
+		routes = append(routes, route.Method+" "+strings.Join(parts, "/"))
+	}
+
+	slices.Sort(documented)
+	slices.Sort(routes)
+	if !slices.Equal(documented, routes) {
+		t.Errorf("routes do not match client/openapi.yaml:\nrouter:  %v\nopenapi: %v", routes, documented)
+	}
+}
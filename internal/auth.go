@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/gin-gonic/gin"
+)
+
+// accessLevel is what a client of the local API is allowed to do
+type accessLevel int
+
+const (
+	accessNone accessLevel = iota
+	// accessRead allows reading the trusted metadata and the refresh status
+	accessRead
+	// accessRefresh also allows triggering refreshes and reading local bundles
+	accessRefresh
+)
+
+// peerCred holds the credentials of the process connected to the unix socket
+type peerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// peerCredKey is the request context key of the *peerCred of unix socket
+// connections. It is set to nil if the credentials could not be read.
+type peerCredKey struct{}
+
+// apiAuth authorizes requests to the local API:
+//   - on the unix socket, based on the UID and primary GID of the peer.
+//     root and the agent's own user are always granted refresh access.
+//   - on TCP, based on a bearer token, if token files are configured.
+type apiAuth struct {
+	token     string
+	readToken string
+
+	refreshUids []uint32
+	refreshGids []uint32
+	readUids    []uint32
+	readGids    []uint32
+}
+
+// loadApiAuth reads the local API authorization rules from sota.toml:
+//
+//	[tuf]
+//	api_token_file = "/var/sota/api-token"
+//	api_read_token_file = "/var/sota/api-read-token"
+//	api_refresh_uids = "1000"
+//	api_refresh_gids = ""
+//	api_read_uids = ""
+//	api_read_gids = "100"
+//
+// Any peer of the unix socket may read if no read UIDs or GIDs are set.
+func loadApiAuth(config *sotatoml.AppConfig) (*apiAuth, error) {
+	var err error
+	auth := &apiAuth{}
+	if auth.token, err = readToken(config.GetDefault("tuf.api_token_file", "")); err != nil {
+		return nil, err
+	}
+	if auth.readToken, err = readToken(config.GetDefault("tuf.api_read_token_file", "")); err != nil {
+		return nil, err
+	}
+	for key, ids := range map[string]*[]uint32{
+		"tuf.api_refresh_uids": &auth.refreshUids,
+		"tuf.api_refresh_gids": &auth.refreshGids,
+		"tuf.api_read_uids":    &auth.readUids,
+		"tuf.api_read_gids":    &auth.readGids,
+	} {
+		if *ids, err = parseIds(config.GetDefault(key, "")); err != nil {
+			return nil, fmt.Errorf("invalid %s value: %w", key, err)
+		}
+	}
+	return auth, nil
+}
+
+// checkListenAddresses refuses TCP addresses reachable from other hosts when
+// no API token is set, as any client of those would be granted refresh access
+func (a *apiAuth) checkListenAddresses(addrs []string) error {
+	if a.token != "" || a.readToken != "" {
+		return nil
+	}
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid tuf.listen address %s: %w", addr, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("tuf.listen address %s is not a loopback address, tuf.api_token_file must be set", addr)
+		}
+	}
+	return nil
+}
+
+func readToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read API token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("API token file %s is empty", path)
+	}
+	return token, nil
+}
+
+func parseIds(val string) ([]uint32, error) {
+	var ids []uint32
+	for _, s := range strings.Split(val, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// grant returns the access level of a request
+func (a *apiAuth) grant(req *http.Request) accessLevel {
+	if cred, ok := req.Context().Value(peerCredKey{}).(*peerCred); ok {
+		return a.grantPeer(cred)
+	}
+	return a.grantToken(req)
+}
+
+func (a *apiAuth) grantPeer(cred *peerCred) accessLevel {
+	switch {
+	case cred == nil:
+		return accessNone
+	case cred.Uid == 0 || cred.Uid == uint32(os.Getuid()):
+		return accessRefresh
+	case slices.Contains(a.refreshUids, cred.Uid) || slices.Contains(a.refreshGids, cred.Gid):
+		return accessRefresh
+	case len(a.readUids) == 0 && len(a.readGids) == 0:
+		return accessRead
+	case slices.Contains(a.readUids, cred.Uid) || slices.Contains(a.readGids, cred.Gid):
+		return accessRead
+	}
+	return accessNone
+}
+
+func (a *apiAuth) grantToken(req *http.Request) accessLevel {
+	if a.token == "" && a.readToken == "" {
+		return accessRefresh
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case !ok:
+		return accessNone
+	case tokenMatches(token, a.token):
+		return accessRefresh
+	case tokenMatches(token, a.readToken):
+		return accessRead
+	}
+	return accessNone
+}
+
+func tokenMatches(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// require aborts requests not granted the given access level
+func (a *apiAuth) require(level accessLevel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		granted := a.grant(c.Request)
+		if granted >= level {
+			return
+		}
+		cred, isUnix := c.Request.Context().Value(peerCredKey{}).(*peerCred)
+		if cred != nil {
+			log.Printf("Denied %s %s to uid %d, gid %d, pid %d", c.Request.Method, c.Request.URL.Path, cred.Uid, cred.Gid, cred.Pid)
+		}
+		if granted == accessNone && !isUnix {
+			c.Header("WWW-Authenticate", "Bearer")
+			abortWithError(c, http.StatusUnauthorized, errors.New("missing or invalid API token"))
+			return
+		}
+		abortWithError(c, http.StatusForbidden, errors.New("not allowed to access this endpoint"))
+	}
+}
+
+// connContext stores the credentials of unix socket peers in the context of
+// their requests
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := getPeerCred(unixConn)
+	if err != nil {
+		log.Println("Unable to read unix socket peer credentials:", err)
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
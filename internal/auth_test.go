@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGrantPeer(t *testing.T) {
+	ownUid := uint32(os.Getuid())
+	foreignUid := ownUid + 1000
+	tests := []struct {
+		name string
+		auth apiAuth
+		cred *peerCred
+		want accessLevel
+	}{
+		{name: "unknown peer", cred: nil, want: accessNone},
+		{name: "root", auth: apiAuth{readUids: []uint32{foreignUid + 1}}, cred: &peerCred{Uid: 0, Gid: 0}, want: accessRefresh},
+		{name: "own uid", auth: apiAuth{readUids: []uint32{foreignUid + 1}}, cred: &peerCred{Uid: ownUid, Gid: 4242}, want: accessRefresh},
+		{name: "foreign uid", cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessRead},
+		{name: "foreign uid not allowed to read", auth: apiAuth{readUids: []uint32{foreignUid + 1}}, cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessNone},
+		{name: "foreign uid allowed to read", auth: apiAuth{readUids: []uint32{foreignUid}}, cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessRead},
+		{name: "foreign gid allowed to read", auth: apiAuth{readGids: []uint32{4242}}, cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessRead},
+		{name: "foreign uid allowed to refresh", auth: apiAuth{refreshUids: []uint32{foreignUid}, readUids: []uint32{foreignUid + 1}}, cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessRefresh},
+		{name: "foreign gid allowed to refresh", auth: apiAuth{refreshGids: []uint32{4242}, readUids: []uint32{foreignUid + 1}}, cred: &peerCred{Uid: foreignUid, Gid: 4242}, want: accessRefresh},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.auth.grantPeer(tt.cred); got != tt.want {
+				t.Errorf("expected access %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGrantToken(t *testing.T) {
+	tokens := apiAuth{token: "refresh-token", readToken: "read-token"}
+	tests := []struct {
+		name          string
+		auth          apiAuth
+		authorization string
+		want          accessLevel
+	}{
+		{name: "no token configured", authorization: "", want: accessRefresh},
+		{name: "missing token", auth: tokens, authorization: "", want: accessNone},
+		{name: "not a bearer token", auth: tokens, authorization: "Basic refresh-token", want: accessNone},
+		{name: "wrong token", auth: tokens, authorization: "Bearer other-token", want: accessNone},
+		{name: "refresh token", auth: tokens, authorization: "Bearer refresh-token", want: accessRefresh},
+		{name: "read token", auth: tokens, authorization: "Bearer read-token", want: accessRead},
+		{name: "empty token", auth: apiAuth{token: "refresh-token"}, authorization: "Bearer ", want: accessNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/targets", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if got := tt.auth.grantToken(req); got != tt.want {
+				t.Errorf("expected access %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckListenAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    apiAuth
+		addrs   []string
+		wantErr bool
+	}{
+		{name: "loopback", addrs: []string{"127.0.0.1:9080", "[::1]:9080", "localhost:9080"}},
+		{name: "unix socket", addrs: []string{"unix:/run/fiotuf.sock"}},
+		{name: "any address", addrs: []string{"127.0.0.1:9080", ":9080"}, wantErr: true},
+		{name: "external address", addrs: []string{"192.168.1.10:9080"}, wantErr: true},
+		{name: "host name", addrs: []string{"device.local:9080"}, wantErr: true},
+		{name: "invalid address", addrs: []string{"127.0.0.1"}, wantErr: true},
+		{name: "any address with token", auth: apiAuth{token: "refresh-token"}, addrs: []string{":9080"}},
+		{name: "any address with read token", auth: apiAuth{readToken: "read-token"}, addrs: []string{":9080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.auth.checkListenAddresses(tt.addrs)
+			if tt.wantErr && err == nil {
+				t.Error("expected the addresses to be refused")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("expected the addresses to be accepted, got %s", err)
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	auth := &apiAuth{token: "refresh-token", readToken: "read-token", readUids: []uint32{4242}}
+	tests := []struct {
+		name          string
+		level         accessLevel
+		cred          *peerCred
+		unix          bool
+		authorization string
+		want          int
+	}{
+		{name: "missing token", level: accessRead, want: http.StatusUnauthorized},
+		{name: "read token", level: accessRead, authorization: "Bearer read-token", want: http.StatusOK},
+		{name: "read token to refresh", level: accessRefresh, authorization: "Bearer read-token", want: http.StatusForbidden},
+		{name: "refresh token", level: accessRefresh, authorization: "Bearer refresh-token", want: http.StatusOK},
+		{name: "unknown peer", level: accessRead, unix: true, want: http.StatusForbidden},
+		{name: "peer allowed to read", level: accessRead, unix: true, cred: &peerCred{Uid: 4242}, want: http.StatusOK},
+		{name: "peer allowed to read only", level: accessRefresh, unix: true, cred: &peerCred{Uid: 4242}, want: http.StatusForbidden},
+		{name: "root peer", level: accessRefresh, unix: true, cred: &peerCred{Uid: 0}, want: http.StatusOK},
+		// tokens are ignored on the unix socket
+		{name: "peer with token", level: accessRefresh, unix: true, cred: &peerCred{Uid: 4243}, authorization: "Bearer refresh-token", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", auth.require(tt.level), func(c *gin.Context) { c.Status(http.StatusOK) })
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.unix {
+				req = req.WithContext(context.WithValue(req.Context(), peerCredKey{}, tt.cred))
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestUnixSocketPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan accessLevel, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			granted <- (&apiAuth{token: "refresh-token"}).grant(r)
+		}),
+		ConnContext: connContext,
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://unix/targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// the token is not needed by the agent's own user
+	if level := <-granted; level != accessRefresh {
+		t.Errorf("expected the agent's own user to be granted refresh access, got %d", level)
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/transport"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/foundriesio/fiotuf/updateclient"
+)
+
+const defaultMaxBackoffSec = 3600
+
+// getMaxBackoff reads the longest delay between update checks after
+// failures, set with tuf.update_max_backoff_sec
+func getMaxBackoff(config *sotatoml.AppConfig) time.Duration {
+	maxSec, err := strconv.Atoi(config.GetDefault("tuf.update_max_backoff_sec", strconv.Itoa(defaultMaxBackoffSec)))
+	if err != nil || maxSec < 0 {
+		log.Printf("Invalid tuf.update_max_backoff_sec value, using %d", defaultMaxBackoffSec)
+		maxSec = defaultMaxBackoffSec
+	}
+	return time.Duration(maxSec) * time.Second
+}
+
+// updateDelay returns the delay before the next update check. The interval
+// doubles after each consecutive failure, up to maxBackoff.
+func updateDelay(interval time.Duration, jitter time.Duration, maxBackoff time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = max(min(delay, maxBackoff), interval)
+	if jitter > 0 {
+		delay += time.Duration(rand.Int64N(int64(jitter)))
+	}
+	return delay
+}
+
+// updateLoop runs the update client right away, then every interval plus a
+// random jitter, backing off after failures, until ctx is done
+func updateLoop(ctx context.Context, uc *updateclient.UpdateClient, interval time.Duration, jitter time.Duration, maxBackoff time.Duration) {
+	log.Printf("Checking for updates every %s (jitter %s)", interval, jitter)
+	failures := 0
+	for {
+		err := uc.Run(ctx, "")
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		delay := updateDelay(interval, jitter, maxBackoff, failures)
+		if failures > 0 {
+			log.Printf("Update check failed %d time(s) in a row, next one in %s", failures, delay.Round(time.Second))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StartUpdateDaemon checks for updates and applies them every
+// uptane.polling_sec seconds until ctx is done. If withAgent is set, the
+// agent API is served as well, sharing the same FioTuf instance and database:
+// the update checks then replace the agent background refreshes, and the
+// update progress is streamed to API clients.
+func StartUpdateDaemon(ctx context.Context, config *sotatoml.AppConfig, withAgent bool) error {
+	interval, jitter := getPollingInterval(config)
+	if interval == 0 {
+		return errors.New("the update daemon requires uptane.polling_sec to be greater than 0")
+	}
+	maxBackoff := getMaxBackoff(config)
+	client := transport.CreateClient(config)
+	if !withAgent {
+		uc, err := updateclient.NewUpdateClient(config, client, nil)
+		if err != nil {
+			return err
+		}
+		updateLoop(ctx, uc, interval, jitter, maxBackoff)
+		return nil
+	}
+
+	fiotuf, err := tuf.NewFioTuf(config, client)
+	if err != nil {
+		log.Println("Error creating fiotuf: ", err)
+		return err
+	}
+	uc, err := updateclient.NewUpdateClient(config, client, fiotuf)
+	if err != nil {
+		return err
+	}
+	a := newAgent(config, fiotuf)
+	uc.OnProgress = a.stream.publishUpdateProgress
+	return runTufAgent(ctx, config, client, a, func(ctx context.Context) {
+		updateLoop(ctx, uc, interval, jitter, maxBackoff)
+	})
+}
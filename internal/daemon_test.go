@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+)
+
+func TestUpdateDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		maxBackoff time.Duration
+		failures   int
+		want       time.Duration
+	}{
+		{name: "no failure", interval: time.Minute, maxBackoff: time.Hour, failures: 0, want: time.Minute},
+		{name: "one failure", interval: time.Minute, maxBackoff: time.Hour, failures: 1, want: 2 * time.Minute},
+		{name: "three failures", interval: time.Minute, maxBackoff: time.Hour, failures: 3, want: 8 * time.Minute},
+		{name: "capped", interval: time.Minute, maxBackoff: time.Hour, failures: 6, want: time.Hour},
+		{name: "many failures", interval: time.Minute, maxBackoff: time.Hour, failures: 1000, want: time.Hour},
+		{name: "backoff below interval", interval: time.Hour, maxBackoff: time.Minute, failures: 2, want: time.Hour},
+		{name: "backoff disabled", interval: time.Minute, maxBackoff: 0, failures: 2, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := updateDelay(tt.interval, 0, tt.maxBackoff, tt.failures); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateDelayJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		got := updateDelay(time.Minute, time.Second, time.Hour, 1)
+		if got < 2*time.Minute || got >= 2*time.Minute+time.Second {
+			t.Fatalf("expected the jitter to be added to the backoff, got %s", got)
+		}
+	}
+}
+
+func TestGetMaxBackoff(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	tests := []struct {
+		name     string
+		settings []string
+		want     time.Duration
+	}{
+		{name: "default", want: defaultMaxBackoffSec * time.Second},
+		{name: "set", settings: []string{`update_max_backoff_sec = "600"`}, want: 10 * time.Minute},
+		{name: "disabled", settings: []string{`update_max_backoff_sec = "0"`}, want: 0},
+		{name: "invalid", settings: []string{`update_max_backoff_sec = "-1"`}, want: defaultMaxBackoffSec * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tuftest.NewConfig(t, repo, "http://localhost", tt.settings...)
+			if got := getMaxBackoff(config); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStartUpdateDaemonRequiresPolling(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	// the test configuration disables polling
+	config := tuftest.NewConfig(t, repo, "http://localhost")
+	if err := StartUpdateDaemon(context.Background(), config, false); err == nil {
+		t.Error("expected the daemon not to start without a polling interval")
+	}
+}
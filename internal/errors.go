@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/gin-gonic/gin"
+)
+
+// errorResponse is the body of failed requests
+type errorResponse struct {
+	Error string        `json:"error"`
+	Kind  tuf.ErrorKind `json:"kind,omitempty"`
+}
+
+// tufErrorStatus maps the kinds of TUF failures to HTTP status codes
+var tufErrorStatus = map[tuf.ErrorKind]int{
+	tuf.ErrKindNetwork:          http.StatusBadGateway,
+	tuf.ErrKindNotFound:         http.StatusNotFound,
+	tuf.ErrKindExpired:          http.StatusConflict,
+	tuf.ErrKindBadSignature:     http.StatusUnprocessableEntity,
+	tuf.ErrKindRollback:         http.StatusPreconditionFailed,
+	tuf.ErrKindLengthMismatch:   http.StatusRequestEntityTooLarge,
+	tuf.ErrKindInvalidMetadata:  http.StatusUnprocessableEntity,
+	tuf.ErrKindBundleUnreadable: http.StatusBadRequest,
+	tuf.ErrKindNoInitialRoot:    http.StatusServiceUnavailable,
+}
+
+// abortWithError ends a request with a JSON error body. TUF failures get a
+// status code depending on their kind, other errors the given status.
+func abortWithError(c *gin.Context, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	var tufErr *tuf.Error
+	if errors.As(err, &tufErr) {
+		resp.Kind = tufErr.Kind
+		if s, ok := tufErrorStatus[tufErr.Kind]; ok {
+			status = s
+		}
+	}
+	_ = c.Error(err)
+	c.AbortWithStatusJSON(status, resp)
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/gin-gonic/gin"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+
+	_ "modernc.org/sqlite"
+)
+
+const defaultReadyGatewayMinutes = 60
+
+var startTime = time.Now().UTC()
+
+// healthCheck is the outcome of one of the checks of /readyz
+type healthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthResponse struct {
+	Status  string        `json:"status"`
+	Started time.Time     `json:"started"`
+	Version string        `json:"version,omitempty"`
+	Checks  []healthCheck `json:"checks,omitempty"`
+}
+
+// readiness checks whether the agent can be relied on
+type readiness struct {
+	fiotuf     *tuf.FioTuf
+	dbFilePath string
+	// gatewayWindow is how recently the device gateway must have been
+	// reached, 0 disables the check
+	gatewayWindow time.Duration
+}
+
+// newReadiness reads the readiness settings from sota.toml. The device
+// gateway must have been reached within tuf.ready_gateway_minutes, 0
+// disabling the check for devices updated offline.
+func newReadiness(config *sotatoml.AppConfig, fiotuf *tuf.FioTuf) *readiness {
+	minutes, err := strconv.Atoi(config.GetDefault("tuf.ready_gateway_minutes", strconv.Itoa(defaultReadyGatewayMinutes)))
+	if err != nil || minutes < 0 {
+		minutes = defaultReadyGatewayMinutes
+	}
+	return &readiness{
+		fiotuf:        fiotuf,
+		dbFilePath:    path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db")),
+		gatewayWindow: time.Duration(minutes) * time.Minute,
+	}
+}
+
+func (r *readiness) check() []healthCheck {
+	checks := []healthCheck{r.checkRoot(), r.checkMetadata(), r.checkDatabase()}
+	if r.gatewayWindow > 0 {
+		checks = append(checks, r.checkGateway())
+	}
+	return checks
+}
+
+func (r *readiness) checkRoot() healthCheck {
+	root := r.fiotuf.GetRoot()
+	if root == nil {
+		return healthCheck{Name: "root", Detail: "no trusted root metadata loaded"}
+	}
+	return healthCheck{Name: "root", Ok: true, Detail: fmt.Sprintf("version %d", root.Signed.Version)}
+}
+
+func (r *readiness) checkMetadata() healthCheck {
+	return checkMetadataExpiry(r.fiotuf.GetMetadataExpiry())
+}
+
+// checkMetadataExpiry fails if a role is expired, or if no timestamp
+// metadata has been verified yet
+func checkMetadataExpiry(expiry []tuf.RoleExpiry) healthCheck {
+	check := healthCheck{Name: "metadata", Ok: true}
+	for _, e := range expiry {
+		if e.Expired {
+			check.Ok = false
+			check.Detail = e.String()
+			return check
+		}
+	}
+	for _, e := range expiry {
+		if e.Role == metadata.TIMESTAMP {
+			check.Detail = "not expired"
+			return check
+		}
+	}
+	check.Ok = false
+	check.Detail = "no metadata verified since the agent started"
+	return check
+}
+
+// checkDatabase makes sure the SQLite database can be written, without
+// modifying it. If it does not exist yet, its directory must be writable.
+func (r *readiness) checkDatabase() healthCheck {
+	check := healthCheck{Name: "database"}
+	if _, err := os.Stat(r.dbFilePath); os.IsNotExist(err) {
+		f, err := os.CreateTemp(filepath.Dir(r.dbFilePath), ".fiotuf-ready-*")
+		if err != nil {
+			check.Detail = fmt.Sprintf("database does not exist and cannot be created: %s", err)
+			return check
+		}
+		f.Close()
+		os.Remove(f.Name())
+		check.Ok = true
+		check.Detail = "not created yet"
+		return check
+	}
+
+	db, err := sql.Open("sqlite", r.dbFilePath)
+	if err != nil {
+		check.Detail = fmt.Sprintf("failed to open database: %s", err)
+		return check
+	}
+	defer db.Close()
+	if err = tryWrite(db); err != nil {
+		check.Detail = fmt.Sprintf("database is not writable: %s", err)
+		return check
+	}
+	check.Ok = true
+	return check
+}
+
+// tryWrite rewrites the user version of the database, in a transaction that
+// is rolled back
+func tryWrite(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "PRAGMA busy_timeout = 5000;"); err != nil {
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "ROLLBACK;")
+
+	var version int
+	if err = conn.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&version); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d;", version))
+	return err
+}
+
+func (r *readiness) checkGateway() healthCheck {
+	check := healthCheck{Name: "gateway"}
+	last := r.fiotuf.GetRefreshStatus().LastGatewayContact
+	if last == nil {
+		check.Detail = "not reached since the agent started"
+		return check
+	}
+	check.Detail = "last reached at " + last.Format(time.RFC3339)
+	check.Ok = time.Since(*last) <= r.gatewayWindow
+	return check
+}
+
+// getHealthHttp tells the agent is running
+func getHealthHttp(c *gin.Context) {
+	c.JSON(http.StatusOK, healthResponse{Status: "ok", Started: startTime, Version: Commit})
+}
+
+// getReadyHttp tells whether the agent holds valid trusted metadata and can
+// persist its state, with the details of each check
+func (a *agent) getReadyHttp(c *gin.Context) {
+	resp := healthResponse{Status: "ok", Started: startTime, Version: Commit, Checks: a.readiness.check()}
+	status := http.StatusOK
+	for _, check := range resp.Checks {
+		if !check.Ok {
+			resp.Status = "failing"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(status, resp)
+}
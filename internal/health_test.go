@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/gin-gonic/gin"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func newTestReadiness(t *testing.T) (*readiness, *tuf.FioTuf) {
+	t.Helper()
+	repo := tuftest.NewRepo(t)
+	gateway := newTestGateway(t, repo)
+	config := tuftest.NewConfig(t, repo, gateway.URL)
+	fiotuf, err := tuf.NewFioTuf(config, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newReadiness(config, fiotuf), fiotuf
+}
+
+// findCheck returns the outcome of the named check
+func findCheck(t *testing.T, checks []healthCheck, name string) healthCheck {
+	t.Helper()
+	for _, check := range checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("expected the %s check to run, got %+v", name, checks)
+	return healthCheck{}
+}
+
+func TestCheckMetadataExpiry(t *testing.T) {
+	now := time.Now()
+	root := tuf.RoleExpiry{Role: metadata.ROOT, Expires: now.Add(time.Hour)}
+	timestamp := tuf.RoleExpiry{Role: metadata.TIMESTAMP, Expires: now.Add(time.Hour)}
+	tests := []struct {
+		name   string
+		expiry []tuf.RoleExpiry
+		want   bool
+	}{
+		{name: "valid", expiry: []tuf.RoleExpiry{root, timestamp}, want: true},
+		{name: "expiring soon", expiry: []tuf.RoleExpiry{root, {Role: metadata.TIMESTAMP, ExpiringSoon: true}}, want: true},
+		{name: "not refreshed", expiry: []tuf.RoleExpiry{root}},
+		{name: "expired", expiry: []tuf.RoleExpiry{root, timestamp, {Role: metadata.TARGETS, Expired: true}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if check := checkMetadataExpiry(tt.expiry); check.Ok != tt.want || check.Detail == "" {
+				t.Errorf("expected the check to be ok: %v, got %+v", tt.want, check)
+			}
+		})
+	}
+}
+
+func TestCheckDatabase(t *testing.T) {
+	dir := t.TempDir()
+	notDb := filepath.Join(dir, "not-a.db")
+	if err := os.WriteFile(notDb, []byte("not a database, not a database, not a database, not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := newTestReadiness(t)
+	tests := []struct {
+		name       string
+		dbFilePath string
+		want       bool
+	}{
+		{name: "not created yet", dbFilePath: filepath.Join(dir, "sql.db"), want: true},
+		{name: "missing directory", dbFilePath: filepath.Join(dir, "missing", "sql.db")},
+		{name: "not a database", dbFilePath: notDb},
+		{name: "directory", dbFilePath: dir},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r.dbFilePath = tt.dbFilePath
+			if check := r.checkDatabase(); check.Ok != tt.want {
+				t.Errorf("expected the check to be ok: %v, got %+v", tt.want, check)
+			}
+		})
+	}
+
+	// an existing database is not modified
+	r.dbFilePath = filepath.Join(dir, "sql.db")
+	if err := createJobsTable(r.dbFilePath); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(r.dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check := r.checkDatabase(); !check.Ok {
+		t.Errorf("expected the database to be writable, got %+v", check)
+	}
+	if after, err := os.ReadFile(r.dbFilePath); err != nil || string(after) != string(before) {
+		t.Errorf("expected the database not to be modified, %v", err)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	r, fiotuf := newTestReadiness(t)
+	if check := findCheck(t, r.check(), "root"); !check.Ok {
+		t.Errorf("expected the initial root to be trusted, got %+v", check)
+	}
+	for _, name := range []string{"metadata", "gateway"} {
+		if check := findCheck(t, r.check(), name); check.Ok {
+			t.Errorf("expected the %s check to fail before the first refresh, got %+v", name, check)
+		}
+	}
+
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range r.check() {
+		if !check.Ok {
+			t.Errorf("expected the %s check to pass after a refresh, got %+v", check.Name, check)
+		}
+	}
+
+	r.gatewayWindow = time.Nanosecond
+	if check := findCheck(t, r.check(), "gateway"); check.Ok {
+		t.Errorf("expected the gateway check to fail once the gateway was not reached recently, got %+v", check)
+	}
+	r.gatewayWindow = 0
+	for _, check := range r.check() {
+		if check.Name == "gateway" {
+			t.Errorf("expected the gateway check to be disabled, got %+v", check)
+		}
+	}
+}
+
+func TestGetReadyHttp(t *testing.T) {
+	r, fiotuf := newTestReadiness(t)
+	router := gin.New()
+	router.GET("/readyz", (&agent{readiness: r}).getReadyHttp)
+	ready := func() (int, healthResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp healthResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp
+	}
+
+	if status, resp := ready(); status != http.StatusServiceUnavailable || resp.Status != "failing" {
+		t.Errorf("expected the agent not to be ready before the first refresh, got %d %+v", status, resp)
+	}
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := ready(); status != http.StatusOK || resp.Status != "ok" || len(resp.Checks) != 4 {
+		t.Errorf("expected the agent to be ready, got %d %+v", status, resp)
+	}
+}
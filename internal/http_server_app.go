@@ -1,88 +1,381 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
 	"github.com/foundriesio/fioconfig/transport"
+	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/metrics"
+	"github.com/foundriesio/fiotuf/targets"
 	"github.com/foundriesio/fiotuf/tuf"
 	"github.com/gin-gonic/gin"
 )
 
-var (
-	globalFioTuf *tuf.FioTuf
-)
+// agent holds the state of a TUF agent, shared by the handlers of its API
+type agent struct {
+	fiotuf    *tuf.FioTuf
+	jobs      *jobQueue
+	stream    *eventStream
+	readiness *readiness
+}
+
+func newAgent(config *sotatoml.AppConfig, fiotuf *tuf.FioTuf) *agent {
+	a := &agent{
+		fiotuf:    fiotuf,
+		jobs:      newJobQueue(config, fiotuf),
+		stream:    newEventStream(),
+		readiness: newReadiness(config, fiotuf),
+	}
+	a.stream.watch(fiotuf)
+	return a
+}
 
 const (
-	httpPort int = 9080 // TODO: make configurable
+	defaultListenAddress = "127.0.0.1:9080"
+	// shutdownTimeout bounds each step of the agent shutdown: waiting for
+	// in-flight requests, then for the running refresh
+	shutdownTimeout = 20 * time.Second
 )
 
 var Commit string
 
-func getTargetsHttp(c *gin.Context) {
-	// ret := []string{}
-	targets := globalFioTuf.GetTargets()
-	// for name := range targets {
-	// 	t, _ := targets[name].MarshalJSON()
-	// 	ret = append(ret, string(t))
-	// }
+func (a *agent) getTargetsHttp(c *gin.Context) {
+	targets := a.fiotuf.GetTargets()
+	if c.Query("filtered") == "true" {
+		targets = a.fiotuf.GetDeviceTargets()
+	}
+	targets = tuf.FilterByHardwareId(targets, c.Query("hardwareId"))
+	if c.Query("provenance") == "true" {
+		delegated := a.fiotuf.GetDelegatedTargets()
+		for name := range delegated {
+			if _, ok := targets[name]; !ok {
+				delete(delegated, name)
+			}
+		}
+		c.IndentedJSON(http.StatusOK, delegated)
+		return
+	}
 	c.IndentedJSON(http.StatusOK, targets)
 }
 
-func getRootHttp(c *gin.Context) {
-	c.JSON(http.StatusOK, globalFioTuf.GetRoot())
-	// c.IndentedJSON(http.StatusOK, fioUpdater.GetTrustedMetadataSet().Root)
+func (a *agent) getRootHttp(c *gin.Context) {
+	c.JSON(http.StatusOK, a.fiotuf.GetRoot())
 }
 
-type tufError struct {
-	s string
+// refreshTufHttp submits a refresh job. Unless async=true is set, the
+// response is only sent once the job is finished.
+func (a *agent) refreshTufHttp(c *gin.Context) {
+	job, err := a.jobs.submit(c.Query("localTufRepo"))
+	if err != nil {
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	c.Header("Location", "/jobs/"+job.ID)
+	if c.Query("async") == "true" {
+		status, _ := a.jobs.get(job.ID)
+		c.JSON(http.StatusAccepted, status)
+		return
+	}
+	select {
+	case <-job.done:
+	case <-c.Request.Context().Done():
+		abortWithError(c, http.StatusServiceUnavailable, errors.New("the agent is shutting down"))
+		return
+	}
+	if job.err != nil {
+		abortWithError(c, http.StatusInternalServerError, job.err)
+		return
+	}
+	c.JSON(http.StatusOK, job)
 }
 
-func (f tufError) Error() string {
-	return "TUF error"
+func (a *agent) getJobsHttp(c *gin.Context) {
+	c.JSON(http.StatusOK, a.jobs.list())
 }
 
-func refreshTufHttp(c *gin.Context) {
-	err := globalFioTuf.RefreshTuf(c.Query("localTufRepo"))
+func (a *agent) getJobHttp(c *gin.Context) {
+	job, ok := a.jobs.get(c.Param("id"))
+	if !ok {
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("no refresh job with ID %s", c.Param("id")))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+func (a *agent) getRefreshStatusHttp(c *gin.Context) {
+	c.JSON(http.StatusOK, a.fiotuf.GetRefreshStatus())
+}
+
+func (a *agent) getMetadataExpiryHttp(c *gin.Context) {
+	c.JSON(http.StatusOK, a.fiotuf.GetMetadataExpiry())
+}
+
+func (a *agent) getMetadataHttp(c *gin.Context) {
+	role := strings.TrimSuffix(c.Param("role"), ".json")
+	data, ok := a.fiotuf.GetRawMetadata(role)
+	if !ok {
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("no trusted metadata for role %s", role))
+		return
+	}
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+func (a *agent) getRootHistoryHttp(c *gin.Context) {
+	history, err := a.fiotuf.GetRootHistory()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+func (a *agent) getRootVersionHttp(c *gin.Context) {
+	version, err := strconv.ParseInt(strings.TrimSuffix(c.Param("version"), ".json"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid root version: %w", err))
+		return
+	}
+	data, err := a.fiotuf.GetRootVersion(version)
+	if errors.Is(err, tuf.ErrRootNotFound) {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+func (a *agent) verifyBundleHttp(c *gin.Context) {
+	bundlePath := c.Query("path")
+	if bundlePath == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("missing offline bundle path"))
+		return
+	}
+	report, err := a.fiotuf.VerifyBundle(bundlePath)
 	if err != nil {
-		errAbort := c.AbortWithError(http.StatusBadRequest, tufError{fmt.Sprintf("failed to create Config instance: %v", err)})
-		if errAbort != nil {
-			log.Println("Error aborting TUF refresh operation request %w", errAbort)
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// getListenAddresses returns the addresses the local API listens on, set
+// with tuf.listen as a comma-separated list. Addresses starting with "unix:"
+// are unix domain sockets.
+func getListenAddresses(config *sotatoml.AppConfig) []string {
+	var addrs []string
+	for _, addr := range strings.Split(config.GetDefault("tuf.listen", defaultListenAddress), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
 		}
 	}
-	c.Done()
+	return addrs
+}
+
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// remove the socket left over by a previous run
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// access is controlled based on the peer credentials
+	if err = os.Chmod(path, 0o666); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
-func startHttpServer() {
-	port := httpPort
+// shutdown stops server gracefully, waiting for in-flight requests up to
+// shutdownTimeout
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down http server: ", err)
+		server.Close()
+	}
+}
+
+// newRouter returns the handler of the local API of a, described in
+// client/openapi.yaml
+func newRouter(a *agent, auth *apiAuth) (*gin.Engine, error) {
 	router := gin.Default()
 	err := router.SetTrustedProxies([]string{"127.0.0.1"})
 	if err != nil {
-		log.Println("Error setting gin router trusted proxies: ", err)
-		return
+		return nil, fmt.Errorf("error setting gin router trusted proxies: %w", err)
 	}
-	router.GET("/targets", getTargetsHttp)
-	router.GET("/root", getRootHttp)
-	router.POST("/targets/update/", refreshTufHttp)
-	log.Println("Starting TUF agent http server at port", port)
-	err = router.Run(":" + strconv.Itoa(port))
+	// left open to supervisors and monitoring
+	router.GET("/healthz", getHealthHttp)
+	router.GET("/readyz", a.getReadyHttp)
+	read := router.Group("", auth.require(accessRead))
+	read.GET("/targets", a.getTargetsHttp)
+	read.GET("/root", a.getRootHttp)
+	read.GET("/targets/update/status", a.getRefreshStatusHttp)
+	read.GET("/jobs", a.getJobsHttp)
+	read.GET("/jobs/:id", a.getJobHttp)
+	read.GET("/events/stream", a.streamEventsHttp)
+	read.GET("/metrics", gin.WrapH(metrics.Handler()))
+	read.GET("/metadata/expiry", a.getMetadataExpiryHttp)
+	read.GET("/metadata/roots", a.getRootHistoryHttp)
+	read.GET("/metadata/:role", a.getMetadataHttp)
+	read.GET("/metadata/root/:version", a.getRootVersionHttp)
+	refresh := router.Group("", auth.require(accessRefresh))
+	refresh.POST("/targets/update/", a.refreshTufHttp)
+	refresh.POST("/bundles/verify", a.verifyBundleHttp)
+	return router, nil
+}
+
+// startHttpServer serves the local API until ctx is done. Requests are
+// given the context of the server, so that long-lived ones like event
+// streams end when shutting down.
+func startHttpServer(ctx context.Context, addrs []string, a *agent, auth *apiAuth) error {
+	router, err := newRouter(a, auth)
 	if err != nil {
-		log.Println("Error starting gin router: ", err)
+		return err
+	}
+	server := &http.Server{
+		Handler:     router,
+		ConnContext: connContext,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	errs := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			server.Close()
+			return fmt.Errorf("unable to listen at %s: %w", addr, err)
+		}
+		log.Println("Starting TUF agent http server at", addr)
+		go func() {
+			errs <- server.Serve(l)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		server.Close()
+		return err
+	case <-ctx.Done():
 	}
+	log.Println("Shutting down TUF agent http server")
+	shutdown(server)
+	return nil
+}
+
+// sendEventAsync sends an event without holding the refresh that triggered
+// it, as sending retries for minutes while the device gateway is unreachable
+func sendEventAsync(client *http.Client, eventsUrl string, evt []events.DgUpdateEvent) {
+	go func() {
+		if err := events.SendEvent(client, eventsUrl, evt); err != nil {
+			log.Println("Error sending event: ", err)
+		}
+	}()
 }
 
-func StartTufAgent(config *sotatoml.AppConfig) error {
+// StartTufAgent runs the agent until ctx is done. It then stops accepting
+// requests, and waits for in-flight requests and refreshes to finish.
+func StartTufAgent(ctx context.Context, config *sotatoml.AppConfig) error {
 	client := transport.CreateClient(config)
 	fiotuf, err := tuf.NewFioTuf(config, client)
 	if err != nil {
 		log.Println("Error creating fiotuf: ", err)
 		return err
 	}
+	interval, jitter := getPollingInterval(config)
+	return runTufAgent(ctx, config, client, newAgent(config, fiotuf), func(ctx context.Context) {
+		if interval > 0 {
+			refreshLoop(ctx, fiotuf, interval, jitter)
+		}
+	})
+}
 
-	globalFioTuf = fiotuf
-	startHttpServer()
-	return nil
+// runTufAgent serves the API of a until ctx is done, while background runs,
+// refreshing the metadata or updating the device. On shutdown, background
+// is waited for along with in-flight requests.
+func runTufAgent(ctx context.Context, config *sotatoml.AppConfig, client *http.Client, a *agent, background func(ctx context.Context)) error {
+	addrs := getListenAddresses(config)
+	if len(addrs) == 0 {
+		return errors.New("no address to listen at, check tuf.listen")
+	}
+	auth, err := loadApiAuth(config)
+	if err != nil {
+		return err
+	}
+	if err = auth.checkListenAddresses(addrs); err != nil {
+		return err
+	}
+
+	fiotuf := a.fiotuf
+	eventsUrl := config.GetDefault("tls.server", "https://ota-lite.foundries.io:8443") + "/events"
+	warner := tuf.NewExpiryWarner(func(e tuf.RoleExpiry) {
+		evt := events.NewEvent(events.MetadataExpiring, e.String(), nil, "", "", 0)
+		sendEventAsync(client, eventsUrl, evt)
+	})
+	fiotuf.AddRefreshListener(func(tuf.RefreshResult) {
+		warner.Check(fiotuf.GetMetadataExpiry())
+	})
+	metrics.SetMetadata(fiotuf.GetMetadataExpiry())
+	metrics.WatchDatabase(path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db")))
+	fiotuf.AddRefreshListener(func(result tuf.RefreshResult) {
+		metrics.ObserveRefresh(result)
+		metrics.SetMetadata(fiotuf.GetMetadataExpiry())
+	})
+	// report failures once per kind, background refreshes keep failing the
+	// same way until the cause is fixed
+	var lastErrorKind tuf.ErrorKind
+	fiotuf.AddRefreshListener(func(result tuf.RefreshResult) {
+		if result.ErrorKind != lastErrorKind && result.ErrorKind != "" {
+			evt := events.NewEvent(events.MetadataUpdateFailed, result.Error, targets.BoolPointer(false), "", "", 0)
+			evt[0].Event.ErrorKind = string(result.ErrorKind)
+			sendEventAsync(client, eventsUrl, evt)
+		}
+		lastErrorKind = result.ErrorKind
+	})
+	if addr := getMirrorAddress(config); addr != "" {
+		go startMirrorServer(ctx, fiotuf, addr)
+	}
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	backgroundDone := make(chan struct{})
+	go func() {
+		defer close(backgroundDone)
+		background(backgroundCtx)
+	}()
+	err = startHttpServer(ctx, addrs, a, auth)
+	stopBackground()
+
+	select {
+	case <-backgroundDone:
+	case <-time.After(shutdownTimeout):
+		log.Println("Background task still running at shutdown")
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := a.jobs.stop(drainCtx); err != nil {
+		log.Println("Refresh job still running at shutdown: ", err)
+	}
+	if err := fiotuf.WaitIdle(drainCtx); err != nil {
+		log.Println("TUF refresh still running at shutdown: ", err)
+	}
+	return err
 }
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestAgent creates an agent trusting repo, with its device gateway at
+// gatewayUrl, and serves its API
+func newTestAgent(t *testing.T, repo *tuftest.Repo, gatewayUrl string, tufSettings ...string) (*agent, *httptest.Server) {
+	t.Helper()
+	config := tuftest.NewConfig(t, repo, gatewayUrl, tufSettings...)
+	fiotuf, err := tuf.NewFioTuf(config, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAgent(config, fiotuf)
+	auth, err := loadApiAuth(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := newRouter(a, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(router)
+	t.Cleanup(func() {
+		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := a.jobs.stop(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+	return a, server
+}
+
+func newTestGateway(t *testing.T, repo *tuftest.Repo) *httptest.Server {
+	server := httptest.NewServer(repo.Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestTargetsDuringRefresh is meant to be run with the race detector
+func TestTargetsDuringRefresh(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	_, server := newTestAgent(t, repo, newTestGateway(t, repo).URL)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, query := range []string{"", "?filtered=true", "?provenance=true"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				res, err := http.Get(server.URL + "/targets" + query)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var targets map[string]json.RawMessage
+				err = json.NewDecoder(res.Body).Decode(&targets)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK || err != nil {
+					t.Errorf("GET /targets%s: status %d, %v", query, res.StatusCode, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 5; i++ {
+		repo.AddTarget(fmt.Sprintf("test-%d", i), i, "test-hwid", "main")
+		res, err := http.Post(server.URL+"/targets/update/", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("refresh failed with status %d", res.StatusCode)
+		}
+
+		res, err = http.Get(server.URL + "/targets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var targets map[string]json.RawMessage
+		err = json.NewDecoder(res.Body).Decode(&targets)
+		res.Body.Close()
+		if err != nil || len(targets) != i {
+			t.Errorf("expected %d targets after the refresh, got %d (%v)", i, len(targets), err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
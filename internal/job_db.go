@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	_ "modernc.org/sqlite"
+)
+
+func createJobsTable(dbFilePath string) error {
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS refresh_jobs(id TEXT PRIMARY KEY, created INTEGER NOT NULL, json_string TEXT NOT NULL);")
+	if err != nil {
+		return fmt.Errorf("failed to create refresh_jobs table: %v", err)
+	}
+	return nil
+}
+
+// saveJob inserts or updates a job, then drops the oldest jobs beyond limit
+func saveJob(dbFilePath string, job *refreshJob, limit int) error {
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job to JSON: %v", err)
+	}
+
+	_, err = db.Exec("INSERT OR REPLACE INTO refresh_jobs (id, created, json_string) VALUES (?, ?, ?);", job.ID, job.Created.UnixNano(), string(jobJSON))
+	if err != nil {
+		return fmt.Errorf("failed to insert job into refresh_jobs: %v", err)
+	}
+
+	_, err = db.Exec("DELETE FROM refresh_jobs WHERE id NOT IN (SELECT id FROM refresh_jobs ORDER BY created DESC LIMIT ?);", limit)
+	if err != nil {
+		return fmt.Errorf("failed to delete old jobs from refresh_jobs: %v", err)
+	}
+	return nil
+}
+
+// loadJobs returns the last limit jobs saved, oldest first
+func loadJobs(dbFilePath string, limit int) ([]*refreshJob, error) {
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT json_string FROM refresh_jobs ORDER BY created DESC LIMIT ?;", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query refresh_jobs: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*refreshJob
+	for rows.Next() {
+		var jobJSON string
+		if err := rows.Scan(&jobJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan refresh_jobs row: %v", err)
+		}
+		var job refreshJob
+		if err := json.Unmarshal([]byte(jobJSON), &job); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal job: %v", err)
+		}
+		jobs = append(jobs, &job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read refresh_jobs: %v", err)
+	}
+	slices.Reverse(jobs)
+	return jobs, nil
+}
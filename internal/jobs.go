@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/google/uuid"
+)
+
+const defaultJobsHistory = 50
+
+// jobState is the state of a refresh job. While running, it is the phase
+// reported by the refresh.
+type jobState string
+
+const (
+	jobQueued jobState = "queued"
+	jobDone   jobState = "done"
+	jobFailed jobState = "failed"
+)
+
+// refreshJob is a refresh requested through the API
+type refreshJob struct {
+	ID string `json:"id"`
+	// Source is the local repository path, or empty for the device gateway
+	Source          string        `json:"source,omitempty"`
+	State           jobState      `json:"state"`
+	Created         time.Time     `json:"created"`
+	Started         *time.Time    `json:"started,omitempty"`
+	Finished        *time.Time    `json:"finished,omitempty"`
+	BytesDownloaded int64         `json:"bytesDownloaded"`
+	Error           string        `json:"error,omitempty"`
+	ErrorKind       tuf.ErrorKind `json:"errorKind,omitempty"`
+
+	// err and the fields above are not modified once done is closed
+	err  error
+	done chan struct{}
+}
+
+func (job *refreshJob) finished() bool {
+	return job.State == jobDone || job.State == jobFailed
+}
+
+// jobQueue runs refresh jobs one at a time, in the order they were
+// submitted, and keeps a bounded history of them
+type jobQueue struct {
+	fiotuf *tuf.FioTuf
+	// dbFilePath is empty if jobs are not persisted
+	dbFilePath string
+	limit      int
+	queue      chan *refreshJob
+
+	mu sync.Mutex
+	// jobs holds the known jobs, oldest first
+	jobs    []*refreshJob
+	current *refreshJob
+	// unsaved holds a copy of the jobs changed since they were last saved,
+	// changed signals there are some
+	unsaved map[string]refreshJob
+	changed chan struct{}
+	// closed is set once the queue is stopped, stopped is closed once the
+	// last job is finished and saved
+	closed  bool
+	stopped chan struct{}
+}
+
+// newJobQueue creates the refresh job queue. The number of jobs kept is set
+// with tuf.jobs_history, and they are also saved to the SQLite database if
+// tuf.persist_jobs is "true", so that they survive restarts.
+func newJobQueue(config *sotatoml.AppConfig, fiotuf *tuf.FioTuf) *jobQueue {
+	limit, err := strconv.Atoi(config.GetDefault("tuf.jobs_history", strconv.Itoa(defaultJobsHistory)))
+	if err != nil || limit < 1 {
+		log.Printf("Invalid tuf.jobs_history value, using %d", defaultJobsHistory)
+		limit = defaultJobsHistory
+	}
+	q := &jobQueue{
+		fiotuf:  fiotuf,
+		limit:   limit,
+		queue:   make(chan *refreshJob, limit),
+		unsaved: map[string]refreshJob{},
+		changed: make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	if config.GetDefault("tuf.persist_jobs", "false") == "true" {
+		q.dbFilePath = path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db"))
+		q.load()
+	}
+	fiotuf.AddProgressListener(q.onProgress)
+	fiotuf.AddRefreshListener(q.onRefresh)
+	go q.run()
+	go q.persist()
+	return q
+}
+
+// load restores the jobs saved by a previous run. Jobs that were not finished
+// have been interrupted.
+func (q *jobQueue) load() {
+	if err := createJobsTable(q.dbFilePath); err != nil {
+		log.Println("Error creating refresh jobs table:", err)
+		q.dbFilePath = ""
+		return
+	}
+	jobs, err := loadJobs(q.dbFilePath, q.limit)
+	if err != nil {
+		log.Println("Error loading refresh jobs:", err)
+		return
+	}
+	for _, job := range jobs {
+		if !job.finished() {
+			now := time.Now().UTC()
+			job.State = jobFailed
+			job.Finished = &now
+			job.Error = "interrupted by an agent restart"
+			q.save(job)
+		}
+		job.done = make(chan struct{})
+		close(job.done)
+	}
+	q.jobs = jobs
+}
+
+// submit queues a refresh job. A job already queued for the same source is
+// returned instead of queuing a new one.
+func (q *jobQueue) submit(source string) (*refreshJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errors.New("the agent is shutting down")
+	}
+	for _, job := range q.jobs {
+		if job.State == jobQueued && job.Source == source {
+			return job, nil
+		}
+	}
+	job := &refreshJob{
+		ID:      uuid.New().String(),
+		Source:  source,
+		State:   jobQueued,
+		Created: time.Now().UTC(),
+		done:    make(chan struct{}),
+	}
+	select {
+	case q.queue <- job:
+	default:
+		return nil, errors.New("too many refresh jobs queued")
+	}
+	q.jobs = append(q.jobs, job)
+	q.trim()
+	q.save(job)
+	return job, nil
+}
+
+// trim drops the oldest finished jobs beyond the history limit
+func (q *jobQueue) trim() {
+	for i := 0; len(q.jobs) > q.limit && i < len(q.jobs); {
+		if q.jobs[i].finished() {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+		} else {
+			i++
+		}
+	}
+}
+
+// get returns a copy of a job, safe to serialize while the job runs
+func (q *jobQueue) get(id string) (refreshJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return refreshJob{}, false
+}
+
+// list returns a copy of the known jobs, most recent first
+func (q *jobQueue) list() []refreshJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ret := make([]refreshJob, 0, len(q.jobs))
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		ret = append(ret, *q.jobs[i])
+	}
+	return ret
+}
+
+// stop cancels the queued jobs and waits for the running one to finish
+func (q *jobQueue) stop(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *jobQueue) run() {
+	defer close(q.changed)
+	for job := range q.queue {
+		q.mu.Lock()
+		if q.closed {
+			now := time.Now().UTC()
+			job.Finished = &now
+			job.State = jobFailed
+			job.Error = "canceled, the agent is shutting down"
+			job.err = errors.New(job.Error)
+			q.save(job)
+			q.mu.Unlock()
+			close(job.done)
+			continue
+		}
+		now := time.Now().UTC()
+		job.Started = &now
+		job.State = jobState(tuf.PhaseRoot)
+		q.current = job
+		q.save(job)
+		q.mu.Unlock()
+
+		err := q.fiotuf.RefreshTuf(context.Background(), job.Source)
+
+		q.mu.Lock()
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		job.State = jobDone
+		if err != nil {
+			job.State = jobFailed
+			job.Error = err.Error()
+			job.ErrorKind = tuf.GetErrorKind(err)
+			job.err = err
+		}
+		q.current = nil
+		q.save(job)
+		q.trim()
+		q.mu.Unlock()
+		close(job.done)
+	}
+}
+
+func (q *jobQueue) onProgress(progress tuf.RefreshProgress) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := q.current
+	if job == nil || job.Source != progress.Source {
+		// a refresh not started by a job
+		return
+	}
+	job.BytesDownloaded = progress.BytesDownloaded
+	if state := jobState(progress.Phase); state != job.State {
+		job.State = state
+		q.save(job)
+	}
+}
+
+func (q *jobQueue) onRefresh(result tuf.RefreshResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job := q.current; job != nil && job.Source == result.Source && result.Transfer != nil {
+		job.BytesDownloaded = result.Transfer.BytesDownloaded
+	}
+}
+
+// save schedules a job to be persisted, if enabled. It must be called with
+// q.mu held.
+func (q *jobQueue) save(job *refreshJob) {
+	if q.dbFilePath == "" {
+		return
+	}
+	q.unsaved[job.ID] = *job
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// persist writes the jobs scheduled by save to the database, without holding
+// q.mu, so that API readers do not wait for disk I/O during refreshes
+func (q *jobQueue) persist() {
+	defer close(q.stopped)
+	for range q.changed {
+		q.mu.Lock()
+		jobs := q.unsaved
+		q.unsaved = map[string]refreshJob{}
+		q.mu.Unlock()
+		for _, job := range jobs {
+			if err := saveJob(q.dbFilePath, &job, q.limit); err != nil {
+				log.Println("Error saving refresh job:", err)
+			}
+		}
+	}
+}
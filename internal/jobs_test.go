@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/tuf"
+)
+
+// blockingGateway serves repo once release is closed. entered receives a
+// value when the first request is waiting.
+type blockingGateway struct {
+	repo    *tuftest.Repo
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newBlockingGateway(t *testing.T) (*blockingGateway, *httptest.Server) {
+	gw := &blockingGateway{
+		repo:    tuftest.NewRepo(t),
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	server := httptest.NewServer(gw)
+	t.Cleanup(server.Close)
+	return gw, server
+}
+
+func (gw *blockingGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case gw.entered <- struct{}{}:
+	default:
+	}
+	<-gw.release
+	gw.repo.Handler().ServeHTTP(w, r)
+}
+
+func newTestJobQueue(t *testing.T, config *sotatoml.AppConfig) *jobQueue {
+	t.Helper()
+	fiotuf, err := tuf.NewFioTuf(config, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newJobQueue(config, fiotuf)
+	t.Cleanup(func() { stopJobQueue(t, q) })
+	return q
+}
+
+func stopJobQueue(t *testing.T, q *jobQueue) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := q.stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func submitJob(t *testing.T, q *jobQueue, source string) *refreshJob {
+	t.Helper()
+	job, err := q.submit(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestJobQueueDedupesQueuedJobs(t *testing.T) {
+	gw, server := newBlockingGateway(t)
+	q := newTestJobQueue(t, tuftest.NewConfig(t, gw.repo, server.URL))
+
+	running := submitJob(t, q, "")
+	<-gw.entered
+	queued := submitJob(t, q, "")
+	if queued == running {
+		t.Error("expected a new job while the previous one runs")
+	}
+	if job := submitJob(t, q, ""); job != queued {
+		t.Errorf("expected the queued job %s to be returned, got %s", queued.ID, job.ID)
+	}
+	bundle := submitJob(t, q, "/missing/bundle")
+	if bundle == queued {
+		t.Error("expected a new job for another source")
+	}
+	close(gw.release)
+	<-bundle.done
+
+	for _, job := range []*refreshJob{running, queued} {
+		<-job.done
+		if job.State != jobDone {
+			t.Errorf("expected job %s to succeed, got %+v", job.ID, job)
+		}
+	}
+	if bundle.State != jobFailed || bundle.ErrorKind != tuf.ErrKindBundleUnreadable {
+		t.Errorf("expected the refresh from a missing bundle to fail, got %+v", bundle)
+	}
+	if n := len(q.list()); n != 3 {
+		t.Errorf("expected 3 jobs, got %d", n)
+	}
+}
+
+func TestJobQueueHistory(t *testing.T) {
+	gw, server := newBlockingGateway(t)
+	q := newTestJobQueue(t, tuftest.NewConfig(t, gw.repo, server.URL, `jobs_history = "2"`))
+
+	// unfinished jobs are kept beyond the limit
+	first := submitJob(t, q, "")
+	<-gw.entered
+	submitJob(t, q, "/bundle-a")
+	last := submitJob(t, q, "/bundle-b")
+	if n := len(q.list()); n != 3 {
+		t.Errorf("expected the 3 unfinished jobs to be kept, got %d", n)
+	}
+	close(gw.release)
+	<-last.done
+
+	jobs := q.list()
+	if len(jobs) != 2 || jobs[0].ID != last.ID {
+		t.Errorf("expected the last 2 jobs, most recent first, got %+v", jobs)
+	}
+	if _, ok := q.get(first.ID); ok {
+		t.Error("expected the oldest job to be dropped")
+	}
+}
+
+func TestJobQueuePersistence(t *testing.T) {
+	gw, server := newBlockingGateway(t)
+	close(gw.release)
+	config := tuftest.NewConfig(t, gw.repo, server.URL, `jobs_history = "2"`, `persist_jobs = "true"`)
+	fiotuf, err := tuf.NewFioTuf(config, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := newJobQueue(config, fiotuf)
+	var jobs []*refreshJob
+	for _, source := range []string{"", "/bundle-a", "/bundle-b"} {
+		job := submitJob(t, q, source)
+		<-job.done
+		jobs = append(jobs, job)
+	}
+	stopJobQueue(t, q)
+
+	// a job saved while running was interrupted by the restart
+	running := &refreshJob{ID: "running", State: jobState(tuf.PhaseTargets), Created: time.Now().UTC()}
+	if err = saveJob(q.dbFilePath, running, q.limit); err != nil {
+		t.Fatal(err)
+	}
+
+	q = newJobQueue(config, fiotuf)
+	defer stopJobQueue(t, q)
+	loaded := q.list()
+	if len(loaded) != 2 || loaded[0].ID != running.ID || loaded[1].ID != jobs[2].ID {
+		t.Fatalf("expected the last 2 jobs to be loaded, got %+v", loaded)
+	}
+	if loaded[0].State != jobFailed || loaded[0].Error == "" {
+		t.Errorf("expected the running job to be failed, got %+v", loaded[0])
+	}
+	if loaded[1].State != jobFailed || loaded[1].ErrorKind != tuf.ErrKindBundleUnreadable {
+		t.Errorf("expected the job to be loaded as it finished, got %+v", loaded[1])
+	}
+}
+
+func TestJobQueueStopCancelsQueuedJobs(t *testing.T) {
+	gw, server := newBlockingGateway(t)
+	q := newTestJobQueue(t, tuftest.NewConfig(t, gw.repo, server.URL))
+
+	running := submitJob(t, q, "")
+	<-gw.entered
+	queued := submitJob(t, q, "/bundle")
+
+	// the queue is closed even if stop does not wait for the running job
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.stop(ctx); err != context.Canceled {
+		t.Fatalf("expected the running job not to be waited for, got %v", err)
+	}
+	close(gw.release)
+	stopJobQueue(t, q)
+
+	if running.State != jobDone {
+		t.Errorf("expected the running job to complete, got %+v", running)
+	}
+	if queued.State != jobFailed || queued.Error == "" {
+		t.Errorf("expected the queued job to be canceled, got %+v", queued)
+	}
+	if _, err := q.submit(""); err == nil {
+		t.Error("expected jobs not to be accepted once stopped")
+	}
+}
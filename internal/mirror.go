@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/gin-gonic/gin"
+)
+
+// getMirrorAddress returns the address the LAN mirror listens on, set with
+// tuf.mirror_listen, like "192.168.1.10:9081". The mirror is disabled if
+// it is not set.
+func getMirrorAddress(config *sotatoml.AppConfig) string {
+	return config.GetDefault("tuf.mirror_listen", "")
+}
+
+// newMirrorRouter serves the verified metadata of fiotuf, and the target
+// files it downloaded, in the TUF repository layout used by the device
+// gateway, so that other devices can list it in tuf.mirrors. Clients verify
+// everything they get, so the mirror does not need to be trusted.
+func newMirrorRouter(fiotuf *tuf.FioTuf) *gin.Engine {
+	router := gin.Default()
+	router.GET("/repo/*path", func(c *gin.Context) {
+		serveRepoFile(c, fiotuf)
+	})
+	return router
+}
+
+func serveRepoFile(c *gin.Context, fiotuf *tuf.FioTuf) {
+	name := strings.TrimPrefix(c.Param("path"), "/")
+	if fiotuf.GetRefreshStatus().LastSuccess == nil {
+		// let clients try the next mirror
+		abortWithError(c, http.StatusServiceUnavailable, errors.New("no metadata has been verified yet"))
+		return
+	}
+
+	var err error
+	if strings.HasSuffix(name, ".json") && !strings.Contains(name, "/") {
+		var data []byte
+		if data, err = fiotuf.GetRepoFile(name); err == nil {
+			c.Data(http.StatusOK, "application/json", data)
+			return
+		}
+	}
+	path, targetErr := fiotuf.GetCachedTargetPath(name)
+	if targetErr != nil {
+		if err == nil {
+			err = targetErr
+		}
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+	c.File(path)
+}
+
+func startMirrorServer(ctx context.Context, fiotuf *tuf.FioTuf, addr string) {
+	server := &http.Server{Addr: addr, Handler: newMirrorRouter(fiotuf)}
+	go func() {
+		<-ctx.Done()
+		shutdown(server)
+	}()
+	log.Println("Starting TUF repository mirror at", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("Error starting TUF repository mirror: ", err)
+	}
+}
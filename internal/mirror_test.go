@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/tuf"
+)
+
+// TestRefreshFromAgentMirror runs two agents: A refreshes from the device
+// gateway and serves a mirror, which B refreshes from while the device
+// gateway is unavailable to it
+func TestRefreshFromAgentMirror(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	repo.AddTarget("test-1", 1, "test-hwid", "main")
+
+	agentA, serverA := newTestAgent(t, repo, newTestGateway(t, repo).URL)
+	res, err := http.Post(serverA.URL+"/targets/update/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh of agent A failed with status %d", res.StatusCode)
+	}
+	mirror := httptest.NewServer(newMirrorRouter(agentA.fiotuf))
+	t.Cleanup(mirror.Close)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(unavailable.Close)
+	agentB, serverB := newTestAgent(t, repo, unavailable.URL, `mirrors = "`+mirror.URL+`/repo"`)
+	res, err = http.Post(serverB.URL+"/targets/update/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("refresh of agent B failed with status %d", res.StatusCode)
+	}
+
+	res, err = http.Get(serverB.URL + "/targets/update/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status tuf.RefreshStatus
+	err = json.NewDecoder(res.Body).Decode(&status)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastSuccess == nil || status.LastSuccess.Sources["timestamp"] != mirror.URL+"/repo" {
+		t.Errorf("expected agent B to refresh from the mirror of agent A, got %+v", status.LastSuccess)
+	}
+	if _, ok := agentB.fiotuf.GetTargets()["test-1"]; !ok {
+		t.Errorf("expected agent B to trust the targets of agent A, got %v", agentB.fiotuf.GetTargets())
+	}
+	if agentA.fiotuf == agentB.fiotuf {
+		t.Error("expected each agent to have its own state")
+	}
+}
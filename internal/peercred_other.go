@@ -0,0 +1,12 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("peer credentials are only supported on Linux")
+}
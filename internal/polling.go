@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/tuf"
+)
+
+const defaultPollingSec = 300
+
+// getPollingInterval reads the background refresh interval and jitter from
+// sota.toml. The interval is taken from uptane.polling_sec, and a value of 0
+// disables background refreshes. Jitter defaults to 10% of the interval and
+// can be set with tuf.polling_jitter_sec.
+func getPollingInterval(config *sotatoml.AppConfig) (time.Duration, time.Duration) {
+	pollingSec, err := strconv.Atoi(config.GetDefault("uptane.polling_sec", strconv.Itoa(defaultPollingSec)))
+	if err != nil || pollingSec < 0 {
+		log.Printf("Invalid uptane.polling_sec value, using %d", defaultPollingSec)
+		pollingSec = defaultPollingSec
+	}
+	jitterSec, err := strconv.Atoi(config.GetDefault("tuf.polling_jitter_sec", strconv.Itoa(pollingSec/10)))
+	if err != nil || jitterSec < 0 {
+		log.Printf("Invalid tuf.polling_jitter_sec value, using %d", pollingSec/10)
+		jitterSec = pollingSec / 10
+	}
+	return time.Duration(pollingSec) * time.Second, time.Duration(jitterSec) * time.Second
+}
+
+// refreshLoop refreshes the TUF metadata from the device gateway right away,
+// then every interval, plus a random jitter, until ctx is done. A refresh is
+// skipped if another one, such as one requested through the HTTP API, is
+// already running.
+func refreshLoop(ctx context.Context, fiotuf *tuf.FioTuf, interval time.Duration, jitter time.Duration) {
+	log.Printf("Refreshing TUF metadata every %s (jitter %s)", interval, jitter)
+	for {
+		if fiotuf.IsRefreshing() {
+			log.Println("A TUF refresh is already in progress, skipping background refresh")
+		} else if err := fiotuf.RefreshTuf(ctx, ""); err != nil {
+			log.Println("Background TUF refresh failed:", err)
+		}
+
+		delay := interval
+		if jitter > 0 {
+			delay += time.Duration(rand.Int64N(int64(jitter)))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
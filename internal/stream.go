@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/foundriesio/fiotuf/updateclient"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// streamKeepAlive is how often a comment is sent on idle streams, so
+	// that clients and proxies do not time them out
+	streamKeepAlive = 30 * time.Second
+	// streamBuffer is the number of events kept for a slow client before
+	// newer ones are dropped
+	streamBuffer = 64
+)
+
+// streamEventType is the type of the events of /events/stream. The data of
+// each type has a fixed schema.
+type streamEventType string
+
+const (
+	// streamRefreshProgress data is a tuf.RefreshProgress
+	streamRefreshProgress streamEventType = "refresh-progress"
+	// streamRefreshFinished data is a tuf.RefreshResult
+	streamRefreshFinished streamEventType = "refresh-finished"
+	// streamTargetsAvailable data is a targetsAvailable
+	streamTargetsAvailable streamEventType = "targets-available"
+	// streamUpdateProgress data is an updateclient.UpdateProgress
+	streamUpdateProgress streamEventType = "update-progress"
+)
+
+// streamEvent is the JSON payload of each server-sent event
+type streamEvent struct {
+	Type streamEventType `json:"type"`
+	Time time.Time       `json:"time"`
+	Data any             `json:"data"`
+}
+
+// targetsAvailable is sent when a refresh brings targets this device may
+// update to that were not there before
+type targetsAvailable struct {
+	Targets []string `json:"targets"`
+}
+
+// eventStream broadcasts events to the clients of /events/stream. The last
+// event of each type is replayed to new clients.
+type eventStream struct {
+	mu          sync.Mutex
+	last        []streamEvent
+	subscribers map[chan streamEvent]struct{}
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subscribers: map[chan streamEvent]struct{}{}}
+}
+
+func (s *eventStream) publish(eventType streamEventType, data any) {
+	evt := streamEvent{Type: eventType, Time: time.Now().UTC(), Data: data}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetLocked(eventType)
+	s.last = append(s.last, evt)
+	for ch := range s.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			// the client is not keeping up, drop the event rather than
+			// blocking the agent
+		}
+	}
+}
+
+// forget stops replaying the last event of a type that no longer describes
+// the current state
+func (s *eventStream) forget(eventType streamEventType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgetLocked(eventType)
+}
+
+func (s *eventStream) forgetLocked(eventType streamEventType) {
+	s.last = slices.DeleteFunc(s.last, func(e streamEvent) bool { return e.Type == eventType })
+}
+
+// subscribe returns a channel receiving the last event of each type, then
+// every new event
+func (s *eventStream) subscribe() chan streamEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := make(chan streamEvent, max(streamBuffer, len(s.last)))
+	for _, evt := range s.last {
+		ch <- evt
+	}
+	s.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (s *eventStream) unsubscribe(ch chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+}
+
+// watch publishes the refreshes of fiotuf, and the targets they make available
+func (s *eventStream) watch(fiotuf *tuf.FioTuf) {
+	known := map[string]bool{}
+	for name := range fiotuf.GetDeviceTargets() {
+		known[name] = true
+	}
+	fiotuf.AddProgressListener(func(progress tuf.RefreshProgress) {
+		s.publish(streamRefreshProgress, progress)
+	})
+	fiotuf.AddRefreshListener(func(result tuf.RefreshResult) {
+		s.forget(streamRefreshProgress)
+		s.publish(streamRefreshFinished, result)
+		if result.Error != "" {
+			return
+		}
+		var added []string
+		for name := range fiotuf.GetDeviceTargets() {
+			if !known[name] {
+				known[name] = true
+				added = append(added, name)
+			}
+		}
+		if len(added) > 0 {
+			slices.Sort(added)
+			s.publish(streamTargetsAvailable, targetsAvailable{Targets: added})
+		}
+	})
+}
+
+// publishUpdateProgress can be set as the OnProgress function of an update
+// client running in the agent
+func (s *eventStream) publishUpdateProgress(progress updateclient.UpdateProgress) {
+	s.publish(streamUpdateProgress, progress)
+}
+
+func (a *agent) streamEventsHttp(c *gin.Context) {
+	ch := a.stream.subscribe()
+	defer a.stream.unsubscribe(ch)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case evt := <-ch:
+			c.SSEvent(string(evt.Type), evt)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/tuf"
+)
+
+// received returns the events buffered in ch
+func received(ch chan streamEvent) []streamEvent {
+	var events []streamEvent
+	for {
+		select {
+		case evt := <-ch:
+			events = append(events, evt)
+		default:
+			return events
+		}
+	}
+}
+
+func eventTypes(events []streamEvent) []streamEventType {
+	var types []streamEventType
+	for _, evt := range events {
+		types = append(types, evt.Type)
+	}
+	return types
+}
+
+func TestEventStreamReplay(t *testing.T) {
+	s := newEventStream()
+	s.publish(streamRefreshProgress, 1)
+	s.publish(streamRefreshFinished, 1)
+	s.publish(streamRefreshProgress, 2)
+
+	ch := s.subscribe()
+	events := received(ch)
+	want := []streamEventType{streamRefreshFinished, streamRefreshProgress}
+	if !slices.Equal(eventTypes(events), want) || events[1].Data != 2 {
+		t.Errorf("expected the last event of each type, got %+v", events)
+	}
+
+	s.forget(streamRefreshProgress)
+	if events = received(s.subscribe()); !slices.Equal(eventTypes(events), []streamEventType{streamRefreshFinished}) {
+		t.Errorf("expected forgotten events not to be replayed, got %+v", events)
+	}
+
+	s.unsubscribe(ch)
+	s.publish(streamUpdateProgress, 1)
+	if events = received(ch); len(events) != 0 {
+		t.Errorf("expected no event once unsubscribed, got %+v", events)
+	}
+}
+
+func TestEventStreamDropsEventsOfSlowClients(t *testing.T) {
+	s := newEventStream()
+	ch := s.subscribe()
+	for i := 0; i < streamBuffer+10; i++ {
+		s.publish(streamUpdateProgress, i)
+	}
+
+	events := received(ch)
+	if len(events) != streamBuffer {
+		t.Fatalf("expected %d events to be buffered, got %d", streamBuffer, len(events))
+	}
+	if events[0].Data != 0 || events[streamBuffer-1].Data != streamBuffer-1 {
+		t.Errorf("expected the newest events to be dropped, got %v to %v", events[0].Data, events[streamBuffer-1].Data)
+	}
+
+	// the client gets new events once it catches up
+	s.publish(streamUpdateProgress, -1)
+	if events = received(ch); len(events) != 1 || events[0].Data != -1 {
+		t.Errorf("expected the next event, got %+v", events)
+	}
+}
+
+func TestEventStreamWatch(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	repo.AddTarget("test-1", 1, "test-hwid", "main")
+	gateway := newTestGateway(t, repo)
+	fiotuf, err := tuf.NewFioTuf(tuftest.NewConfig(t, repo, gateway.URL), http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newEventStream()
+	s.watch(fiotuf)
+
+	available := func() []string {
+		t.Helper()
+		var ret []string
+		for _, evt := range received(s.subscribe()) {
+			if evt.Type == streamRefreshProgress {
+				t.Errorf("expected the progress not to be replayed after the refresh, got %+v", evt)
+			}
+			if evt.Type == streamTargetsAvailable {
+				ret = evt.Data.(targetsAvailable).Targets
+			}
+		}
+		return ret
+	}
+
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if targets := available(); !slices.Equal(targets, []string{"test-1"}) {
+		t.Errorf("expected test-1 to be available, got %v", targets)
+	}
+
+	// only new targets of this device are reported
+	repo.AddTarget("test-2", 2, "test-hwid", "main")
+	repo.AddTarget("test-3", 3, "test-hwid", "main")
+	repo.AddTarget("other-1", 1, "other-hwid", "main")
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if targets := available(); !slices.Equal(targets, []string{"test-2", "test-3"}) {
+		t.Errorf("expected test-2 and test-3 to be available, got %v", targets)
+	}
+}
@@ -0,0 +1,266 @@
+// Package tuftest builds TUF repositories signed with throwaway keys, and
+// sota.toml configurations trusting them, for tests
+package tuftest
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// Repo is a TUF repository laid out like an offline bundle: the metadata is
+// in the repo directory of Dir
+type Repo struct {
+	Dir string
+
+	t         testing.TB
+	keys      map[string]ed25519.PrivateKey
+	root      *metadata.Metadata[metadata.RootType]
+	targets   map[string]*metadata.Metadata[metadata.TargetsType]
+	snapshot  *metadata.Metadata[metadata.SnapshotType]
+	timestamp *metadata.Metadata[metadata.TimestampType]
+}
+
+// NewRepo creates and publishes a repository without targets
+func NewRepo(t testing.TB) *Repo {
+	t.Helper()
+	expires := time.Now().UTC().AddDate(1, 0, 0)
+	r := &Repo{
+		Dir:       t.TempDir(),
+		t:         t,
+		keys:      map[string]ed25519.PrivateKey{},
+		root:      metadata.Root(expires),
+		targets:   map[string]*metadata.Metadata[metadata.TargetsType]{metadata.TARGETS: metadata.Targets(expires)},
+		snapshot:  metadata.Snapshot(expires),
+		timestamp: metadata.Timestamp(time.Now().UTC().AddDate(0, 0, 1)),
+	}
+	r.root.Signed.ConsistentSnapshot = true
+	for _, role := range []string{metadata.ROOT, metadata.TARGETS, metadata.SNAPSHOT, metadata.TIMESTAMP} {
+		if err := r.root.Signed.AddKey(r.newKey(role), role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(r.MetadataDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	r.sign(r.root, metadata.ROOT)
+	r.write(r.root, "1.root.json")
+	r.write(r.root, "root.json")
+	r.publish()
+	return r
+}
+
+// MetadataDir is the directory holding the metadata, which can be passed as
+// localTufRepo to refresh from
+func (r *Repo) MetadataDir() string {
+	return filepath.Join(r.Dir, "repo")
+}
+
+// RootBytes returns the signed root metadata, to be provisioned on devices
+func (r *Repo) RootBytes() []byte {
+	data, err := r.root.ToBytes(false)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return data
+}
+
+// newKey generates the signing key of role
+func (r *Repo) newKey(role string) *metadata.Key {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	key, err := metadata.KeyFromPublicKey(priv.Public())
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.keys[role] = priv
+	return key
+}
+
+// AddTarget adds a target for the given hardware ID and tag, and publishes
+// new versions of the targets, snapshot and timestamp metadata
+func (r *Repo) AddTarget(name string, version int, hardwareId string, tag string) {
+	r.t.Helper()
+	r.AddRoleTarget(metadata.TARGETS, name, version, hardwareId, tag)
+}
+
+// AddRoleTarget adds a target to the targets role, which is either the
+// top-level one or a delegated one, and publishes it
+func (r *Repo) AddRoleTarget(role string, name string, version int, hardwareId string, tag string) {
+	r.t.Helper()
+	md := r.targetsRole(role)
+	target, err := metadata.TargetFile().FromBytes(name, []byte(name))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	custom, err := json.Marshal(map[string]any{
+		"version":     fmt.Sprint(version),
+		"hardwareIds": []string{hardwareId},
+		"tags":        []string{tag},
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	target.Custom = (*json.RawMessage)(&custom)
+	md.Signed.Targets[name] = target
+	md.Signed.Version++
+	r.snapshot.Signed.Version++
+	r.timestamp.Signed.Version++
+	r.publish()
+}
+
+// Delegate delegates the targets matching the path patterns from the parent
+// targets role to a new role, and publishes both. With terminating set, the
+// roles parent delegates to after this one are not searched for the targets
+// matching patterns.
+func (r *Repo) Delegate(parent string, role string, patterns []string, terminating bool) {
+	r.t.Helper()
+	md := r.targetsRole(parent)
+	if _, ok := r.targets[role]; ok {
+		r.t.Fatalf("targets role %s already exists", role)
+	}
+	key := r.newKey(role)
+	if md.Signed.Delegations == nil {
+		md.Signed.Delegations = &metadata.Delegations{Keys: map[string]*metadata.Key{}}
+	}
+	md.Signed.Delegations.Keys[key.ID()] = key
+	md.Signed.Delegations.Roles = append(md.Signed.Delegations.Roles, metadata.DelegatedRole{
+		Name:        role,
+		KeyIDs:      []string{key.ID()},
+		Threshold:   1,
+		Terminating: terminating,
+		Paths:       patterns,
+	})
+	r.targets[role] = metadata.Targets(md.Signed.Expires)
+	md.Signed.Version++
+	r.snapshot.Signed.Version++
+	r.timestamp.Signed.Version++
+	r.publish()
+}
+
+// RoleFile returns the path of the current version of a targets role
+func (r *Repo) RoleFile(role string) string {
+	return filepath.Join(r.MetadataDir(), fmt.Sprintf("%d.%s.json", r.targetsRole(role).Signed.Version, role))
+}
+
+func (r *Repo) targetsRole(role string) *metadata.Metadata[metadata.TargetsType] {
+	md, ok := r.targets[role]
+	if !ok {
+		r.t.Fatalf("unknown targets role %s", role)
+	}
+	return md
+}
+
+// publish signs and writes the targets roles, snapshot and timestamp
+// metadata
+func (r *Repo) publish() {
+	roles := make([]string, 0, len(r.targets))
+	for role := range r.targets {
+		roles = append(roles, role)
+	}
+	slices.Sort(roles)
+	for _, role := range roles {
+		md := r.targets[role]
+		r.sign(md, role)
+		r.write(md, fmt.Sprintf("%d.%s.json", md.Signed.Version, role))
+		r.snapshot.Signed.Meta[role+".json"] = metadata.MetaFile(md.Signed.Version)
+	}
+	r.sign(r.snapshot, metadata.SNAPSHOT)
+	r.write(r.snapshot, fmt.Sprintf("%d.snapshot.json", r.snapshot.Signed.Version))
+	r.timestamp.Signed.Meta["snapshot.json"] = metadata.MetaFile(r.snapshot.Signed.Version)
+	r.sign(r.timestamp, metadata.TIMESTAMP)
+	r.write(r.timestamp, "timestamp.json")
+}
+
+type signable interface {
+	ClearSignatures()
+	Sign(signature.Signer) (*metadata.Signature, error)
+}
+
+func (r *Repo) sign(md signable, role string) {
+	signer, err := signature.LoadSigner(r.keys[role], crypto.Hash(0))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	md.ClearSignatures()
+	if _, err = md.Sign(signer); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *Repo) write(md interface{ ToFile(string, bool) error }, name string) {
+	if err := md.ToFile(filepath.Join(r.MetadataDir(), name), false); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// Handler serves the repository at /repo, like the device gateway.
+// If-Modified-Since is ignored, as metadata can be rewritten within the one
+// second resolution of Last-Modified.
+func (r *Repo) Handler() http.Handler {
+	files := http.FileServer(http.Dir(r.Dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Header.Del("If-Modified-Since")
+		files.ServeHTTP(w, req)
+	})
+}
+
+// NewConfig writes a sota.toml for a "ci" device provisioned with the root
+// metadata of r, talking to the device gateway at server, and loads it.
+// Extra settings of the [tuf] section can be given as "key = value" lines.
+func NewConfig(t testing.TB, r *Repo, server string, tufSettings ...string) *sotatoml.AppConfig {
+	t.Helper()
+	dir := t.TempDir()
+	provisionDir := filepath.Join(dir, "provision")
+	if err := os.MkdirAll(filepath.Join(provisionDir, "ci"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(provisionDir, "ci", "1.root.json"), r.RootBytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	toml := fmt.Sprintf(`[tls]
+server = %q
+
+[storage]
+path = %q
+
+[pacman]
+tags = "main"
+
+[provision]
+primary_ecu_hardware_id = "test-hwid"
+
+[uptane]
+polling_sec = "0"
+
+[tuf]
+provision_path = %q
+device_type = "ci"
+fetch_retries = "0"
+%s
+`, server, dir, provisionDir, strings.Join(tufSettings, "\n"))
+	path := filepath.Join(dir, "sota.toml")
+	if err := os.WriteFile(path, []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := sotatoml.NewAppConfig([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
 	"github.com/foundriesio/fiotuf/internal"
+	"github.com/foundriesio/fiotuf/tuf"
 	"github.com/foundriesio/fiotuf/updateclient"
 	"github.com/urfave/cli/v2"
 )
 
-func tufHttpAgent(c *cli.Context) error {
+// loadConfig reads the sota.toml files set with --config, exiting on error
+func loadConfig(c *cli.Context) *sotatoml.AppConfig {
 	configPaths := c.StringSlice("config")
 	if len(configPaths) == 0 {
 		configPaths = sotatoml.DEF_CONFIG_ORDER
@@ -21,18 +31,144 @@ func tufHttpAgent(c *cli.Context) error {
 		log.Println("ERROR - unable to decode sota.toml:", err)
 		os.Exit(1)
 	}
+	return config
+}
+
+func tufHttpAgent(c *cli.Context) error {
+	config := loadConfig(c)
 	log.Print("Starting TUF client HTTP agent")
-	err = internal.StartTufAgent(config)
+	err := internal.StartTufAgent(c.Context, config)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func metadataExpiry(c *cli.Context) error {
+	config := loadConfig(c)
+	expiry, err := tuf.GetLocalMetadataExpiry(config)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tVERSION\tEXPIRES\tSTATUS")
+	for _, e := range expiry {
+		status := "ok"
+		if e.Expired {
+			status = "expired"
+		} else if e.ExpiringSoon {
+			status = "expiring soon"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Role, e.Version, e.Expires.Format(time.RFC3339), status)
+	}
+	return w.Flush()
+}
+
+func rootHistory(c *cli.Context) error {
+	config := loadConfig(c)
+	history, err := tuf.GetRootHistory(config)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tEXPIRES\tROLE\tTHRESHOLD\tKEYS")
+	for _, info := range history {
+		version := strconv.FormatInt(info.Version, 10)
+		if info.Current {
+			version += " (current)"
+		}
+		expires := info.Expires.Format(time.RFC3339)
+		for _, name := range info.SortedRoles() {
+			role := info.Roles[name]
+			var keys []string
+			for _, key := range role.Keys {
+				keys = append(keys, fmt.Sprintf("%s (%s)", key.ID, key.Type))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", version, expires, name, role.Threshold, strings.Join(keys, ", "))
+			version, expires = "", ""
+		}
+	}
+	return w.Flush()
+}
+
+func verifyBundle(c *cli.Context) error {
+	config := loadConfig(c)
+	srcDir := c.Args().First()
+	if srcDir == "" {
+		srcDir = c.String("src-dir")
+	}
+	if srcDir == "" {
+		return fmt.Errorf("the offline bundle directory must be specified")
+	}
+	report, err := tuf.VerifyBundle(config, srcDir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Reference time: %s (%s)\n\n", report.ReferenceTime.Time.Format(time.RFC3339), report.ReferenceTime.Source)
+	fmt.Fprintln(w, "ROLE\tVERSION\tEXPIRES\tSTATUS")
+	for _, e := range report.Expiry {
+		status := "ok"
+		if e.Expired {
+			status = "expired"
+		} else if e.ExpiringSoon {
+			status = "expiring soon"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Role, e.Version, e.Expires.Format(time.RFC3339), status)
+	}
+	if len(report.Targets) > 0 {
+		fmt.Fprintln(w, "\nTARGET\tVERSION\tROLE\tHARDWARE ID\tTAG")
+		for _, t := range report.Targets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.Version, t.Role, matchStatus(t.MatchesHardwareId), matchStatus(t.MatchesTag))
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("offline bundle verification failed: %s", report.Error)
+	}
+	fmt.Println("\nOffline bundle is valid")
+	return nil
+}
+
+func exportBundle(c *cli.Context) error {
+	config := loadConfig(c)
+	outDir := c.String("out")
+	report, err := tuf.ExportBundle(config, outDir)
+	if err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("exported metadata is not valid: %s", report.Error)
+	}
+	if c.Bool("apps") {
+		if err = updateclient.ExportTargetApps(config, outDir); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Offline bundle written to %s, with %d targets\n", outDir, len(report.Targets))
+	return nil
+}
+
+func matchStatus(match bool) string {
+	if match {
+		return "match"
+	}
+	return "no match"
+}
+
 func updateClient(c *cli.Context) error {
 	srcDir := c.String("src-dir")
 
-	return updateclient.RunUpdateClient(srcDir, c.StringSlice("config"))
+	return updateclient.RunUpdateClient(c.Context, srcDir, c.StringSlice("config"))
+}
+
+func updateDaemon(c *cli.Context) error {
+	config := loadConfig(c)
+	log.Print("Starting update daemon")
+	return internal.StartUpdateDaemon(c.Context, config, c.Bool("agent"))
 }
 
 func main() {
@@ -69,6 +205,60 @@ func main() {
 					return updateClient(c)
 				},
 			},
+			{
+				Name:  "update-daemon",
+				Usage: "Check for updates and apply them every uptane.polling_sec seconds",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "agent",
+						Usage: "Serve the TUF client HTTP agent API as well, from the same process",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return updateDaemon(c)
+				},
+			},
+			{
+				Name:  "metadata-expiry",
+				Usage: "Display the expiration of the locally stored TUF metadata",
+				Action: func(c *cli.Context) error {
+					return metadataExpiry(c)
+				},
+			},
+			{
+				Name:  "root-history",
+				Usage: "Display the root metadata versions trusted by this device and their keys",
+				Action: func(c *cli.Context) error {
+					return rootHistory(c)
+				},
+			},
+			{
+				Name:      "verify-bundle",
+				Usage:     "Verify an offline update bundle against the trusted TUF metadata, without applying it",
+				ArgsUsage: "[BUNDLE_DIR]",
+				Action: func(c *cli.Context) error {
+					return verifyBundle(c)
+				},
+			},
+			{
+				Name:  "export-bundle",
+				Usage: "Write the trusted TUF metadata as an offline update bundle, to be used by another device",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "out",
+						Aliases:  []string{"o"},
+						Usage:    "Directory to write the offline bundle to",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "apps",
+						Usage: "Include the compose apps of the current target",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return exportBundle(c)
+				},
+			},
 			{
 				Name:  "version",
 				Usage: "Display version of this command",
@@ -81,7 +271,18 @@ func main() {
 		DefaultCommand: "start-http-agent",
 	}
 
-	err := app.Run(os.Args)
+	// commands stop gracefully on the first signal, a second one kills them
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, stopping. Send it again to exit immediately", sig)
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cancel()
+	}()
+	err := app.RunContext(ctx, os.Args)
+	cancel()
 	if err != nil {
 		log.Fatal(err)
 	}
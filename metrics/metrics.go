@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/targets"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fiotuf"
+
+// UpdatePhase is a step of an update timed by ObserveUpdatePhase
+type UpdatePhase string
+
+const (
+	PhasePull    UpdatePhase = "pull"
+	PhaseInstall UpdatePhase = "install"
+	PhaseStart   UpdatePhase = "start"
+)
+
+var (
+	refreshDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "refresh_duration_seconds",
+		Help:      "Duration of TUF metadata refreshes, by outcome.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120},
+	}, []string{"outcome"})
+	refreshFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refresh_failures_total",
+		Help:      "Failed TUF metadata refreshes, by kind of failure.",
+	}, []string{"kind"})
+	metadataBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "metadata_downloaded_bytes_total",
+		Help:      "TUF metadata downloaded from remote repositories, by role.",
+	}, []string{"role"})
+	metadataVersion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "metadata_version",
+		Help:      "Version of the trusted metadata of each role.",
+	}, []string{"role"})
+	metadataExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "metadata_expiry_timestamp_seconds",
+		Help:      "Expiration time of the trusted metadata of each role.",
+	}, []string{"role"})
+	updatePhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "update_phase_duration_seconds",
+		Help:      "Duration of the pull, install and start phases of updates, by outcome.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"phase", "outcome"})
+	rollbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rollbacks_total",
+		Help:      "Rollbacks to the previous target after a failed update.",
+	})
+
+	watchDatabaseOnce sync.Once
+)
+
+func outcome(failed bool) string {
+	if failed {
+		return "failure"
+	}
+	return "success"
+}
+
+// ObserveRefresh records the outcome of a refresh. It is meant to be used as
+// a FioTuf refresh listener.
+func ObserveRefresh(result tuf.RefreshResult) {
+	if !result.StartTime.IsZero() {
+		refreshDuration.WithLabelValues(outcome(result.Error != "")).Observe(result.Time.Sub(result.StartTime).Seconds())
+	}
+	if result.Error != "" {
+		refreshFailures.WithLabelValues(string(result.ErrorKind)).Inc()
+	}
+	if result.Transfer != nil {
+		for role, n := range result.Transfer.BytesByRole {
+			metadataBytes.WithLabelValues(role).Add(float64(n))
+		}
+	}
+}
+
+// SetMetadata records the version and expiration of the trusted roles
+func SetMetadata(expiry []tuf.RoleExpiry) {
+	metadataVersion.Reset()
+	metadataExpiry.Reset()
+	for _, e := range expiry {
+		metadataVersion.WithLabelValues(e.Role).Set(float64(e.Version))
+		metadataExpiry.WithLabelValues(e.Role).Set(float64(e.Expires.Unix()))
+	}
+}
+
+// ObserveUpdatePhase records the duration of an update phase started at start
+func ObserveUpdatePhase(phase UpdatePhase, start time.Time, err error) {
+	updatePhaseDuration.WithLabelValues(string(phase), outcome(err != nil)).Observe(time.Since(start).Seconds())
+}
+
+// IncRollbacks counts a rollback
+func IncRollbacks() {
+	rollbacks.Inc()
+}
+
+// WatchDatabase exposes the current target version and the number of events
+// waiting to be reported, read from the SQLite database at each scrape.
+// Only the first call has an effect.
+func WatchDatabase(dbFilePath string) {
+	watchDatabaseOnce.Do(func() {
+		prometheus.MustRegister(&dbCollector{dbFilePath: dbFilePath})
+	})
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+var (
+	currentTargetVersionDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "current_target_version"),
+		"Version of the target currently installed.", nil, nil)
+	pendingEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pending_events"),
+		"Events waiting to be reported to the device gateway.", nil, nil)
+)
+
+// dbCollector reads metrics from the database. Metrics are omitted while the
+// database has not been initialized.
+type dbCollector struct {
+	dbFilePath string
+}
+
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- currentTargetVersionDesc
+	ch <- pendingEventsDesc
+}
+
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	// opening a missing database would create it
+	if _, err := os.Stat(c.dbFilePath); err != nil {
+		return
+	}
+	if version, err := targets.GetCurrentTargetVersion(c.dbFilePath); err == nil {
+		ch <- prometheus.MustNewConstMetric(currentTargetVersionDesc, prometheus.GaugeValue, float64(version))
+	}
+	if count, err := events.CountEvents(c.dbFilePath); err == nil {
+		ch <- prometheus.MustNewConstMetric(pendingEventsDesc, prometheus.GaugeValue, float64(count))
+	}
+}
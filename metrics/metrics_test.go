@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/targets"
+	"github.com/foundriesio/fiotuf/tuf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRegistered(t *testing.T) {
+	start := time.Now()
+	ObserveRefresh(tuf.RefreshResult{StartTime: start, Time: start.Add(time.Second), Error: "failed", ErrorKind: tuf.ErrKindNetwork})
+	SetMetadata([]tuf.RoleExpiry{{Role: "root", Version: 1, Expires: start}})
+	ObserveUpdatePhase(PhasePull, start, nil)
+	IncRollbacks()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{
+		"fiotuf_refresh_duration_seconds",
+		"fiotuf_refresh_failures_total",
+		"fiotuf_metadata_version",
+		"fiotuf_metadata_expiry_timestamp_seconds",
+		"fiotuf_update_phase_duration_seconds",
+		"fiotuf_rollbacks_total",
+	} {
+		if !strings.Contains(w.Body.String(), "\n# TYPE "+name+" ") {
+			t.Errorf("expected %s to be exposed", name)
+		}
+	}
+}
+
+func TestObserveRefresh(t *testing.T) {
+	failures := testutil.ToFloat64(refreshFailures.WithLabelValues(string(tuf.ErrKindExpired)))
+	targetsBytes := testutil.ToFloat64(metadataBytes.WithLabelValues("targets"))
+
+	ObserveRefresh(tuf.RefreshResult{Transfer: &tuf.TransferStats{BytesByRole: map[string]int64{"targets": 100}}})
+	ObserveRefresh(tuf.RefreshResult{Error: "expired", ErrorKind: tuf.ErrKindExpired})
+
+	if n := testutil.ToFloat64(refreshFailures.WithLabelValues(string(tuf.ErrKindExpired))) - failures; n != 1 {
+		t.Errorf("expected a failure to be counted, got %v", n)
+	}
+	if n := testutil.ToFloat64(metadataBytes.WithLabelValues("targets")) - targetsBytes; n != 100 {
+		t.Errorf("expected 100 bytes to be counted, got %v", n)
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	expires := time.Now().Truncate(time.Second)
+	SetMetadata([]tuf.RoleExpiry{{Role: "root", Version: 1, Expires: expires}, {Role: "targets", Version: 3, Expires: expires}})
+	SetMetadata([]tuf.RoleExpiry{{Role: "root", Version: 2, Expires: expires}})
+
+	if n := testutil.CollectAndCount(metadataVersion); n != 1 {
+		t.Errorf("expected the roles no longer trusted to be dropped, got %d", n)
+	}
+	if v := testutil.ToFloat64(metadataVersion.WithLabelValues("root")); v != 2 {
+		t.Errorf("expected root version 2, got %v", v)
+	}
+	if v := testutil.ToFloat64(metadataExpiry.WithLabelValues("root")); v != float64(expires.Unix()) {
+		t.Errorf("expected root to expire at %d, got %v", expires.Unix(), v)
+	}
+}
+
+func TestObserveUpdatePhase(t *testing.T) {
+	ObserveUpdatePhase(PhaseInstall, time.Now(), errors.New("failed"))
+	if n := testutil.CollectAndCount(updatePhaseDuration); n == 0 {
+		t.Error("expected the phase to be observed")
+	}
+	rollbacksBefore := testutil.ToFloat64(rollbacks)
+	IncRollbacks()
+	if n := testutil.ToFloat64(rollbacks) - rollbacksBefore; n != 1 {
+		t.Errorf("expected a rollback to be counted, got %v", n)
+	}
+}
+
+func TestDbCollector(t *testing.T) {
+	dbFilePath := filepath.Join(t.TempDir(), "sql.db")
+	collector := &dbCollector{dbFilePath: dbFilePath}
+	if n := testutil.CollectAndCount(collector); n != 0 {
+		t.Errorf("expected no metrics before the database is created, got %d", n)
+	}
+
+	if err := targets.CreateTargetsTable(dbFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := events.CreateEventsTable(dbFilePath); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		evt := events.NewEvent(events.NoCompatibleTarget, "test", nil, "", "", 0)
+		if err := events.SaveEvent(dbFilePath, &evt[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `
+# HELP fiotuf_pending_events Events waiting to be reported to the device gateway.
+# TYPE fiotuf_pending_events gauge
+fiotuf_pending_events 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "fiotuf_pending_events"); err != nil {
+		t.Error(err)
+	}
+}
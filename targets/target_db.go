@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 
 	"github.com/theupdateframework/go-tuf/v2/metadata"
 
@@ -20,6 +22,11 @@ func BoolPointer(b bool) *bool {
 	return &b
 }
 
+// MaxInstallAttempts is the number of times the installation of a target is
+// started before it is considered failing, if it never completes. That is
+// the case when the device reboots or the update client is killed during it.
+const MaxInstallAttempts = 3
+
 const (
 	updateModeCurrent int = 1
 	updateModePending int = 2
@@ -63,9 +70,17 @@ CREATE TABLE IF NOT EXISTS installed_versions(
 		return fmt.Errorf("failed to create installed_versions table: %v", err)
 	}
 
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS install_attempts(name TEXT PRIMARY KEY, count INTEGER NOT NULL DEFAULT 0);")
+	if err != nil {
+		return fmt.Errorf("failed to create install_attempts table: %v", err)
+	}
+
 	return nil
 }
 
+// IsFailingTarget tells if the installation of a target failed. A target
+// whose installation is pending, because it was interrupted, is not failing
+// so that it is resumed, unless it was started MaxInstallAttempts times.
 func IsFailingTarget(dbFilePath string, name string) (bool, error) {
 	db, err := sql.Open("sqlite", dbFilePath)
 	if err != nil {
@@ -73,7 +88,10 @@ func IsFailingTarget(dbFilePath string, name string) (bool, error) {
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT name FROM installed_versions WHERE name = ? AND was_installed = 0;", name)
+	rows, err := db.Query(`
+SELECT name FROM installed_versions WHERE name = ? AND was_installed = 0 AND
+	(is_pending = 0 OR (SELECT count FROM install_attempts WHERE name = ?) >= ?);`,
+		name, name, MaxInstallAttempts)
 	if err != nil {
 		return false, fmt.Errorf("failed to select installed_versions: %v", err)
 	}
@@ -131,6 +149,30 @@ func GetCurrentTarget(dbFilePath string) (*metadata.TargetFiles, error) {
 	return target, nil
 }
 
+// GetCurrentTargetVersion returns the version of the current target, or 0
+// if no target has been installed yet
+func GetCurrentTargetVersion(dbFilePath string) (int, error) {
+	db, err := sql.Open("sqlite", dbFilePath)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var customMeta string
+	err = db.QueryRow("SELECT custom_meta FROM installed_versions WHERE is_current = 1;").Scan(&customMeta)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var custom TargetCustom
+	if err = json.Unmarshal([]byte(customMeta), &custom); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal custom metadata: %v '%s'", err, customMeta)
+	}
+	return strconv.Atoi(custom.Version)
+}
+
 func saveInstalledVersions(dbFilePath string, target *metadata.TargetFiles, correlationId string, updateMode int) error {
 	log.Println("Saving installed versions", target.Path, updateMode)
 	db, err := sql.Open("sqlite", dbFilePath)
@@ -176,6 +218,18 @@ func saveInstalledVersions(dbFilePath string, target *metadata.TargetFiles, corr
 		}
 	}
 
+	if updateMode == updateModePending {
+		_, err = db.Exec(
+			"INSERT INTO install_attempts (name, count) VALUES (?, 1) ON CONFLICT(name) DO UPDATE SET count = count + 1;",
+			target.Path,
+		)
+	} else {
+		_, err = db.Exec("DELETE FROM install_attempts WHERE name = ?;", target.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save install attempts: %v", err)
+	}
+
 	if oldWasInstalled != nil {
 		if updateMode == updateModeFailed {
 			_, err = db.Exec(
@@ -0,0 +1,145 @@
+package tuf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// BundleRepoPath returns the TUF repository of an offline bundle. Offline
+// bundles are given as their directory, as in VerifyBundle and ExportBundle,
+// while RefreshTuf takes the repository itself.
+func BundleRepoPath(bundlePath string) string {
+	return filepath.Join(bundlePath, "repo")
+}
+
+// isTufRepo tells whether dir holds TUF metadata
+func isTufRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "timestamp.json"))
+	return err == nil
+}
+
+// BundleReport is the outcome of the verification of an offline bundle
+type BundleReport struct {
+	Path          string         `json:"path"`
+	Valid         bool           `json:"valid"`
+	Error         string         `json:"error,omitempty"`
+	ErrorKind     ErrorKind      `json:"errorKind,omitempty"`
+	ReferenceTime ReferenceTime  `json:"referenceTime"`
+	Expiry        []RoleExpiry   `json:"expiry"`
+	Targets       []BundleTarget `json:"targets"`
+}
+
+// BundleTarget describes a target of an offline bundle, and whether it can
+// be installed on this device
+type BundleTarget struct {
+	Name              string   `json:"name"`
+	Version           string   `json:"version"`
+	Role              string   `json:"role"`
+	HardwareIds       []string `json:"hardwareIds"`
+	Tags              []string `json:"tags"`
+	MatchesHardwareId bool     `json:"matchesHardwareId"`
+	MatchesTag        bool     `json:"matchesTag"`
+}
+
+// VerifyBundle runs the TUF verification of the repo directory of an offline
+// bundle against the metadata currently trusted by the device, without
+// updating it. Verification failures are reported in the returned
+// BundleReport; an error is only returned if verification could not run.
+func VerifyBundle(config *sotatoml.AppConfig, bundlePath string) (*BundleReport, error) {
+	paths := getTufPaths(config)
+	repoPath := BundleRepoPath(bundlePath)
+	if _, err := os.Stat(repoPath); err != nil {
+		if isTufRepo(bundlePath) {
+			err = fmt.Errorf("%s is the TUF repository of a bundle, give the bundle directory containing it", bundlePath)
+		}
+		return nil, &Error{Kind: ErrKindBundleUnreadable, Err: fmt.Errorf("invalid offline bundle %s: %w", bundlePath, err)}
+	}
+
+	// Work on a copy of the trusted metadata, so that the usual rollback
+	// checks apply while the real metadata dir stays untouched
+	tmpDir, err := os.MkdirTemp("", "fiotuf-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = copyTrustedMetadata(paths.metadataDir, tmpDir); err != nil {
+		return nil, err
+	}
+	tmpPaths := paths
+	tmpPaths.metadataDir = tmpDir
+	if _, err = importInitialRoot(tmpPaths); err != nil {
+		return nil, err
+	}
+
+	up, tufCfg, err := newFioUpdater(config, nil, tmpPaths, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	ref := newRefClock(paths).now()
+	up.UnsafeSetRefTime(ref.Time)
+
+	report := &BundleReport{Path: bundlePath, ReferenceTime: ref, Targets: []BundleTarget{}}
+	var view *targetsView
+	if err = refreshUpdater(up); err == nil {
+		view, err = loadTargetsView(up, tufCfg)
+	}
+	if err != nil {
+		log.Printf("Offline bundle %s verification failed: %s", bundlePath, err)
+		report.Error = err.Error()
+		report.ErrorKind = GetErrorKind(err)
+	} else {
+		report.Valid = true
+	}
+
+	// roles verified before a failure are reported as well
+	report.Expiry = snapshotExpiry(newTufSnapshot(up, tufCfg, view), ref.Time, getExpiryWarningWindow(config))
+	if view == nil {
+		return report, nil
+	}
+
+	tags := GetTags(config)
+	hwid := GetHardwareId(config)
+	for name, t := range view.targets {
+		tc := parseTargetCustom(t.Target)
+		report.Targets = append(report.Targets, BundleTarget{
+			Name:              name,
+			Version:           tc.Version,
+			Role:              t.Role,
+			HardwareIds:       tc.HardwareIds,
+			Tags:              tc.Tags,
+			MatchesHardwareId: tc.matchesHardwareId(hwid),
+			MatchesTag:        tc.matchesTags(tags),
+		})
+	}
+	sort.Slice(report.Targets, func(i, j int) bool { return report.Targets[i].Name < report.Targets[j].Name })
+	return report, nil
+}
+
+// VerifyBundle verifies an offline bundle against the metadata trusted by
+// this instance. See VerifyBundle.
+func (fiotuf *FioTuf) VerifyBundle(bundlePath string) (*BundleReport, error) {
+	return VerifyBundle(fiotuf.config, bundlePath)
+}
+
+// copyTrustedMetadata copies the metadata files of the local metadata dir
+func copyTrustedMetadata(src string, dst string) error {
+	files, err := filepath.Glob(filepath.Join(src, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(dst, filepath.Base(file)), data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
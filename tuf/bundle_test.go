@@ -0,0 +1,33 @@
+package tuf
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBundlePaths(t *testing.T) {
+	fiotuf, gw := newTestFioTuf(t)
+	gw.repo.AddTarget("test-1", 1, "test-hwid", "main")
+	bundlePath := gw.repo.Dir
+	repoPath := BundleRepoPath(bundlePath)
+
+	// offline bundles are given as their directory
+	report, err := VerifyBundle(fiotuf.config, bundlePath)
+	if err != nil || !report.Valid {
+		t.Errorf("expected the bundle directory to be verified, got %+v, %v", report, err)
+	}
+	if _, err = VerifyBundle(fiotuf.config, repoPath); GetErrorKind(err) != ErrKindBundleUnreadable {
+		t.Errorf("expected the repo directory to be rejected as a bundle, got %v", err)
+	}
+
+	// refreshes take the repository itself
+	if err = fiotuf.RefreshTuf(context.Background(), bundlePath); GetErrorKind(err) != ErrKindBundleUnreadable {
+		t.Errorf("expected the bundle directory to be rejected as a repository, got %v", err)
+	}
+	if err = fiotuf.RefreshTuf(context.Background(), repoPath); err != nil {
+		t.Errorf("expected the refresh from the repo directory to succeed, got %v", err)
+	}
+	if _, ok := fiotuf.GetTargets()["test-1"]; !ok {
+		t.Errorf("expected the targets of the bundle, got %v", fiotuf.GetTargets())
+	}
+}
@@ -0,0 +1,135 @@
+package tuf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// httpCacheFile is kept out of the *.json namespace of the metadata dir,
+// which is listed as metadata
+const httpCacheFile = "http_cache"
+
+// httpCache keeps the ETag and Last-Modified headers of metadata responses,
+// so that metadata that did not change is not downloaded again. The body of
+// a "304 Not Modified" response is read from the local metadata dir, which
+// only holds the latest version of each role, so the hash of each response
+// is kept as well to make sure the local file is the one that was served.
+type httpCache struct {
+	path        string
+	metadataDir string
+
+	mu      sync.Mutex
+	entries map[string]httpCacheEntry
+	dirty   bool
+}
+
+type httpCacheEntry struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Sha256       string `json:"sha256"`
+}
+
+func loadHttpCache(paths tufPaths) *httpCache {
+	cache := &httpCache{
+		path:        filepath.Join(paths.metadataDir, httpCacheFile),
+		metadataDir: paths.metadataDir,
+		entries:     map[string]httpCacheEntry{},
+	}
+	data, err := os.ReadFile(cache.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Unable to read HTTP cache %s: %s", cache.path, err)
+		}
+		return cache
+	}
+	if err = json.Unmarshal(data, &cache.entries); err != nil {
+		log.Printf("Ignoring invalid HTTP cache %s: %s", cache.path, err)
+		cache.entries = map[string]httpCacheEntry{}
+	}
+	return cache
+}
+
+// lookup returns the validators of a URL, along with the local copy of the
+// response, if it is still available
+func (cache *httpCache) lookup(urlPath string) (httpCacheEntry, []byte, bool) {
+	cache.mu.Lock()
+	entry, ok := cache.entries[urlPath]
+	cache.mu.Unlock()
+	if !ok {
+		return entry, nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(cache.metadataDir, url.PathEscape(roleFromPath(urlPath))+".json"))
+	if err != nil || sha256Hex(data) != entry.Sha256 {
+		return entry, nil, false
+	}
+	return entry, data, true
+}
+
+// store records the validators of a response, if there are any. The entries
+// of the other versions of the same role are dropped, as only the latest one
+// is kept in the metadata dir, which also bounds the size of the cache.
+func (cache *httpCache) store(urlPath string, etag string, lastModified string, data []byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	dir, role := urlPath[:strings.LastIndex(urlPath, "/")+1], roleFromPath(urlPath)
+	for key := range cache.entries {
+		if key != urlPath && strings.HasPrefix(key, dir) && !strings.Contains(key[len(dir):], "/") && roleFromPath(key) == role {
+			delete(cache.entries, key)
+			cache.dirty = true
+		}
+	}
+	if etag == "" && lastModified == "" {
+		if _, ok := cache.entries[urlPath]; ok {
+			delete(cache.entries, urlPath)
+			cache.dirty = true
+		}
+		return
+	}
+	cache.entries[urlPath] = httpCacheEntry{ETag: etag, LastModified: lastModified, Sha256: sha256Hex(data)}
+	cache.dirty = true
+}
+
+// save persists the cache if it changed
+func (cache *httpCache) save() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.dirty {
+		return nil
+	}
+	data, err := json.Marshal(cache.entries)
+	if err != nil {
+		return err
+	}
+	if err = sotatoml.SafeWrite(cache.path, data); err != nil {
+		return err
+	}
+	cache.dirty = false
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TransferStats counts the metadata transferred from remote repositories
+// during a refresh
+type TransferStats struct {
+	Requests int `json:"requests"`
+	// NotModified is the number of "304 Not Modified" responses, whose
+	// content was read from the local metadata dir
+	NotModified     int              `json:"notModified"`
+	BytesDownloaded int64            `json:"bytesDownloaded"`
+	BytesSaved      int64            `json:"bytesSaved"`
+	BytesByRole     map[string]int64 `json:"bytesByRole"`
+}
@@ -0,0 +1,103 @@
+package tuf
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// etagServer serves repo with an ETag, answering "304 Not Modified" to
+// requests for content the client already has. It counts these responses.
+func etagServer(t *testing.T, repo *tuftest.Repo) (*httptest.Server, *atomic.Int32) {
+	var notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(filepath.Join(repo.Dir, filepath.FromSlash(r.URL.Path)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		etag := `"` + sha256Hex(data) + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server, &notModified
+}
+
+func TestRefreshNotModified(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	repo.AddTarget("test-1", 1, "test-hwid", "main")
+	server, notModified := etagServer(t, repo)
+	fiotuf, err := NewFioTuf(tuftest.NewConfig(t, repo, server.URL), server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if stats := fiotuf.GetRefreshStatus().LastSuccess.Transfer; stats.NotModified != 0 || stats.BytesSaved != 0 {
+		t.Errorf("expected the first refresh to download everything, got %+v", stats)
+	}
+
+	// the timestamp did not change, so no other role is requested
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := os.ReadFile(filepath.Join(repo.MetadataDir(), "timestamp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := fiotuf.GetRefreshStatus().LastSuccess.Transfer
+	if stats.NotModified != 1 || stats.BytesSaved != int64(len(timestamp)) || notModified.Load() != 1 {
+		t.Errorf("expected the timestamp to be read from the cache, got %+v", stats)
+	}
+
+	repo.AddTarget("test-2", 2, "test-hwid", "main")
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if stats = fiotuf.GetRefreshStatus().LastSuccess.Transfer; stats.NotModified != 0 {
+		t.Errorf("expected the new metadata to be downloaded, got %+v", stats)
+	}
+	if n := len(fiotuf.GetTargets()); n != 2 {
+		t.Errorf("expected 2 targets, got %d", n)
+	}
+}
+
+func TestHttpCacheKeepsLatestVersions(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	server, _ := etagServer(t, repo)
+	fiotuf, err := NewFioTuf(tuftest.NewConfig(t, repo, server.URL), server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		repo.AddTarget("test", i, "test-hwid", "main")
+		if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roles := map[string]int{}
+	for urlPath := range loadHttpCache(getTufPaths(fiotuf.config)).entries {
+		roles[roleFromPath(urlPath)]++
+	}
+	for _, role := range []string{metadata.TIMESTAMP, metadata.SNAPSHOT, metadata.TARGETS} {
+		if roles[role] != 1 {
+			t.Errorf("expected a single cache entry for %s, got %v", role, roles)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package tuf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/config"
+	"github.com/theupdateframework/go-tuf/v2/metadata/trustedmetadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
+)
+
+// DelegatedTarget is a target file annotated with the role that provided it.
+// DelegationPath lists the roles walked from the top-level "targets" role
+// down to Role, both included.
+type DelegatedTarget struct {
+	Target         *metadata.TargetFiles `json:"target"`
+	Role           string                `json:"role"`
+	DelegationPath []string              `json:"delegationPath"`
+}
+
+// targetsView holds all targets roles reachable from the top-level targets
+// role, along with the resolved (merged) targets list
+type targetsView struct {
+	roles   map[string]*metadata.Metadata[metadata.TargetsType]
+	targets map[string]*DelegatedTarget
+}
+
+type roleParent struct {
+	role   string
+	parent string
+}
+
+type delegationStep struct {
+	role  string
+	chain []string
+}
+
+// loadTargetsView loads every delegated targets role reachable from the
+// top-level targets role and resolves the merged targets list. Metadata is
+// verified against the trusted metadata set of the given updater, so this
+// must only be called after a successful Refresh.
+func loadTargetsView(up *updater.Updater, cfg *config.UpdaterConfig) (*targetsView, error) {
+	trusted := up.GetTrustedMetadataSet()
+	top, ok := trusted.Targets[metadata.TARGETS]
+	if !ok {
+		return nil, fmt.Errorf("top-level targets metadata is not loaded")
+	}
+
+	view := &targetsView{
+		roles:   map[string]*metadata.Metadata[metadata.TargetsType]{metadata.TARGETS: top},
+		targets: map[string]*DelegatedTarget{},
+	}
+
+	// Load delegated roles in pre-order, so that a role delegated by more
+	// than one parent is verified against the most trusted one. A role that
+	// cannot be loaded is skipped, along with the roles it delegates to: the
+	// targets they provide are not resolved.
+	failed := map[string]bool{}
+	toVisit := []roleParent{{role: metadata.TARGETS}}
+	for len(toVisit) > 0 {
+		cur := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		md, ok := view.roles[cur.role]
+		if !ok {
+			if len(view.roles) > cfg.MaxDelegations {
+				log.Printf("Maximum number of delegations (%d) reached, not loading role %s", cfg.MaxDelegations, cur.role)
+				continue
+			}
+			var err error
+			md, err = loadDelegatedRole(&trusted, cfg, cur.role, cur.parent)
+			if err != nil {
+				log.Printf("Unable to load delegated role %s, skipping it: %s", cur.role, err)
+				failed[cur.role] = true
+				continue
+			}
+			view.roles[cur.role] = md
+		} else if cur.role != metadata.TARGETS {
+			continue
+		}
+
+		children := delegatedRoleNames(md.Signed.Delegations)
+		slices.Reverse(children)
+		for _, child := range children {
+			if _, visited := view.roles[child]; !visited && !failed[child] {
+				toVisit = append(toVisit, roleParent{role: child, parent: cur.role})
+			}
+		}
+	}
+
+	for _, md := range view.roles {
+		for name := range md.Signed.Targets {
+			if _, ok := view.targets[name]; ok {
+				continue
+			}
+			target, err := view.resolve(name)
+			if err != nil {
+				log.Printf("Ignoring target %s: %s", name, err)
+				continue
+			}
+			view.targets[name] = target
+		}
+	}
+	return view, nil
+}
+
+// delegatedRoleNames returns the names of all roles delegated by a targets
+// role, in order of appearance
+func delegatedRoleNames(delegations *metadata.Delegations) []string {
+	if delegations == nil {
+		return nil
+	}
+	if delegations.Roles != nil {
+		names := make([]string, 0, len(delegations.Roles))
+		for _, r := range delegations.Roles {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	if delegations.SuccinctRoles != nil {
+		return delegations.SuccinctRoles.GetRoles()
+	}
+	return nil
+}
+
+// loadDelegatedRole reads a delegated role from the local metadata dir,
+// falling back to the remote repository if it is missing or not valid
+func loadDelegatedRole(trusted *trustedmetadata.TrustedMetadata, cfg *config.UpdaterConfig, role string, parent string) (*metadata.Metadata[metadata.TargetsType], error) {
+	fileName := filepath.Join(cfg.LocalMetadataDir, url.PathEscape(role)+".json")
+	if data, err := os.ReadFile(fileName); err == nil {
+		md, err := trusted.UpdateDelegatedTargets(data, role, parent)
+		if err == nil {
+			return md, nil
+		}
+		if !errors.Is(err, &metadata.ErrRepository{}) {
+			return nil, err
+		}
+		log.Printf("Local %s metadata is not valid, fetching it from remote", role)
+	}
+
+	metaInfo, ok := trusted.Snapshot.Signed.Meta[role+".json"]
+	if !ok {
+		return nil, fmt.Errorf("role %s not found in snapshot", role)
+	}
+	length := metaInfo.Length
+	if length == 0 {
+		length = cfg.TargetsMaxLength
+	}
+	urlPath := strings.TrimSuffix(cfg.RemoteMetadataURL, "/") + "/"
+	if trusted.Root.Signed.ConsistentSnapshot {
+		urlPath += strconv.FormatInt(metaInfo.Version, 10) + "."
+	}
+	urlPath += url.PathEscape(role) + ".json"
+
+	data, err := cfg.Fetcher.DownloadFile(urlPath, length, defaultFetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	md, err := trusted.UpdateDelegatedTargets(data, role, parent)
+	if err != nil {
+		return nil, err
+	}
+	if err = sotatoml.SafeWrite(fileName, data); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// resolve looks up a target the same way go-tuf does: a pre-order depth-first
+// walk of the delegations tree, honoring path patterns and terminating
+// delegations. The first role providing the target wins.
+func (view *targetsView) resolve(name string) (*DelegatedTarget, error) {
+	toVisit := []delegationStep{{role: metadata.TARGETS, chain: []string{metadata.TARGETS}}}
+	visited := map[string]bool{}
+	for len(toVisit) > 0 {
+		cur := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if visited[cur.role] {
+			continue
+		}
+		md, ok := view.roles[cur.role]
+		if !ok {
+			return nil, fmt.Errorf("delegated role %s is not loaded", cur.role)
+		}
+		if target, ok := md.Signed.Targets[name]; ok {
+			return &DelegatedTarget{Target: target, Role: cur.role, DelegationPath: cur.chain}, nil
+		}
+		visited[cur.role] = true
+		if md.Signed.Delegations == nil {
+			continue
+		}
+
+		var children []delegationStep
+		for _, r := range md.Signed.Delegations.GetRolesForTarget(name) {
+			chain := append(slices.Clone(cur.chain), r.Name)
+			children = append(children, delegationStep{role: r.Name, chain: chain})
+			if r.Terminating {
+				toVisit = nil
+				break
+			}
+		}
+		slices.Reverse(children)
+		toVisit = append(toVisit, children...)
+	}
+	return nil, fmt.Errorf("target %s not found", name)
+}
@@ -0,0 +1,152 @@
+package tuf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/config"
+	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
+)
+
+// loadTestView refreshes from repo, then loads its delegations. A
+// maxDelegations of 0 keeps the go-tuf default.
+func loadTestView(t *testing.T, repo *tuftest.Repo, maxDelegations int) *targetsView {
+	t.Helper()
+	repoUrl := "file://" + repo.MetadataDir()
+	cfg, err := config.New(repoUrl, repo.RootBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LocalMetadataDir = t.TempDir()
+	cfg.LocalTargetsDir = filepath.Join(cfg.LocalMetadataDir, "download")
+	cfg.Fetcher = newFioFetcher(nil, "", []string{repoUrl}, 0)
+	if maxDelegations > 0 {
+		cfg.MaxDelegations = maxDelegations
+	}
+	up, err := updater.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = up.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	view, err := loadTargetsView(up, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return view
+}
+
+func TestLoadTargetsView(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup          func(r *tuftest.Repo)
+		maxDelegations int
+		// want maps the targets expected to be resolved to their
+		// delegation path
+		want map[string][]string
+	}{
+		{
+			name: "pre-order",
+			setup: func(r *tuftest.Repo) {
+				r.Delegate(metadata.TARGETS, "a", []string{"*"}, false)
+				r.Delegate(metadata.TARGETS, "b", []string{"*"}, false)
+				r.Delegate("a", "c", []string{"*"}, false)
+				r.AddTarget("test-1", 1, "test-hwid", "main")
+				r.AddRoleTarget("a", "test-1", 2, "test-hwid", "main")
+				r.AddRoleTarget("b", "test-2", 1, "test-hwid", "main")
+				r.AddRoleTarget("c", "test-2", 2, "test-hwid", "main")
+				r.AddRoleTarget("b", "test-3", 1, "test-hwid", "main")
+			},
+			want: map[string][]string{
+				"test-1": {"targets"},
+				"test-2": {"targets", "a", "c"},
+				"test-3": {"targets", "b"},
+			},
+		},
+		{
+			name: "path patterns",
+			setup: func(r *tuftest.Repo) {
+				r.Delegate(metadata.TARGETS, "a", []string{"lmp-*"}, false)
+				r.AddRoleTarget("a", "lmp-1", 1, "test-hwid", "main")
+				r.AddRoleTarget("a", "other-1", 1, "test-hwid", "main")
+			},
+			want: map[string][]string{
+				"lmp-1": {"targets", "a"},
+			},
+		},
+		{
+			name: "terminating delegation",
+			setup: func(r *tuftest.Repo) {
+				r.Delegate(metadata.TARGETS, "a", []string{"lmp-*"}, true)
+				r.Delegate(metadata.TARGETS, "b", []string{"*"}, false)
+				r.AddRoleTarget("b", "lmp-1", 1, "test-hwid", "main")
+				r.AddRoleTarget("b", "other-1", 1, "test-hwid", "main")
+			},
+			want: map[string][]string{
+				"other-1": {"targets", "b"},
+			},
+		},
+		{
+			name: "max delegations",
+			setup: func(r *tuftest.Repo) {
+				r.Delegate(metadata.TARGETS, "a", []string{"*"}, false)
+				r.Delegate(metadata.TARGETS, "b", []string{"*"}, false)
+				r.AddRoleTarget("a", "test-1", 1, "test-hwid", "main")
+				r.AddRoleTarget("b", "test-2", 1, "test-hwid", "main")
+			},
+			maxDelegations: 1,
+			want: map[string][]string{
+				"test-1": {"targets", "a"},
+			},
+		},
+		{
+			name: "role failing to load",
+			setup: func(r *tuftest.Repo) {
+				r.Delegate(metadata.TARGETS, "a", []string{"other-*"}, false)
+				r.Delegate("a", "c", []string{"*"}, false)
+				r.Delegate(metadata.TARGETS, "b", []string{"*"}, false)
+				r.AddRoleTarget("a", "other-1", 1, "test-hwid", "main")
+				r.AddRoleTarget("c", "other-2", 1, "test-hwid", "main")
+				r.AddRoleTarget("b", "test-1", 1, "test-hwid", "main")
+				if err := os.Remove(r.RoleFile("a")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string][]string{
+				"test-1": {"targets", "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tuftest.NewRepo(t)
+			tt.setup(repo)
+			view := loadTestView(t, repo, tt.maxDelegations)
+
+			for name, path := range tt.want {
+				target, ok := view.targets[name]
+				if !ok {
+					t.Errorf("expected target %s to be resolved", name)
+					continue
+				}
+				if !slices.Equal(target.DelegationPath, path) {
+					t.Errorf("expected target %s to be resolved through %v, got %v", name, path, target.DelegationPath)
+				}
+				if target.Role != path[len(path)-1] {
+					t.Errorf("expected target %s to be provided by %s, got %s", name, path[len(path)-1], target.Role)
+				}
+			}
+			for name := range view.targets {
+				if _, ok := tt.want[name]; !ok {
+					t.Errorf("expected target %s not to be resolved", name)
+				}
+			}
+		})
+	}
+}
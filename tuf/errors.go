@@ -0,0 +1,117 @@
+package tuf
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// ErrorKind classifies TUF failures, so that they can be handled and
+// reported without parsing error messages
+type ErrorKind string
+
+const (
+	// ErrKindNetwork: the repository could not be reached, or returned an
+	// unexpected HTTP status
+	ErrKindNetwork ErrorKind = "network"
+	// ErrKindNotFound: a metadata file is missing from the repository
+	ErrKindNotFound ErrorKind = "not-found"
+	// ErrKindExpired: metadata is expired, which also detects freeze attacks
+	ErrKindExpired ErrorKind = "expired"
+	// ErrKindBadSignature: metadata is not signed by a threshold of trusted keys
+	ErrKindBadSignature ErrorKind = "bad-signature"
+	// ErrKindRollback: metadata is older than the trusted one (rollback attack)
+	ErrKindRollback ErrorKind = "rollback"
+	// ErrKindLengthMismatch: metadata is larger than allowed, or does not
+	// match the length or hashes listed by the referring role
+	ErrKindLengthMismatch ErrorKind = "length-mismatch"
+	// ErrKindInvalidMetadata: metadata could not be parsed or is inconsistent
+	ErrKindInvalidMetadata ErrorKind = "invalid-metadata"
+	// ErrKindBundleUnreadable: a local repository or offline bundle could
+	// not be read
+	ErrKindBundleUnreadable ErrorKind = "bundle-unreadable"
+	// ErrKindNoInitialRoot: there is no trusted root metadata to start from
+	ErrKindNoInitialRoot ErrorKind = "no-initial-root"
+	ErrKindUnknown       ErrorKind = "unknown"
+)
+
+// Error is a TUF failure of a known kind, wrapping the original error.
+// errors.Is matches any Error of the same kind, so callers can check for
+// instance errors.Is(err, tuf.ErrExpired).
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+var (
+	ErrNetwork          = &Error{Kind: ErrKindNetwork}
+	ErrNotFound         = &Error{Kind: ErrKindNotFound}
+	ErrExpired          = &Error{Kind: ErrKindExpired}
+	ErrBadSignature     = &Error{Kind: ErrKindBadSignature}
+	ErrRollback         = &Error{Kind: ErrKindRollback}
+	ErrLengthMismatch   = &Error{Kind: ErrKindLengthMismatch}
+	ErrInvalidMetadata  = &Error{Kind: ErrKindInvalidMetadata}
+	ErrBundleUnreadable = &Error{Kind: ErrKindBundleUnreadable}
+	ErrNoInitialRoot    = &Error{Kind: ErrKindNoInitialRoot}
+)
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Kind)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+// GetErrorKind returns the kind of a TUF failure
+func GetErrorKind(err error) ErrorKind {
+	var tufErr *Error
+	if errors.As(classifyError(err), &tufErr) {
+		return tufErr.Kind
+	}
+	return ""
+}
+
+// classifyError wraps errors returned by go-tuf and the fetcher in an Error
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var tufErr *Error
+	if errors.As(err, &tufErr) {
+		return err
+	}
+
+	var httpErr *metadata.ErrDownloadHTTP
+	var netErr *errNetwork
+	kind := ErrKindUnknown
+	switch {
+	case errors.Is(err, &metadata.ErrExpiredMetadata{}):
+		kind = ErrKindExpired
+	case errors.Is(err, &metadata.ErrUnsignedMetadata{}):
+		kind = ErrKindBadSignature
+	case errors.Is(err, &metadata.ErrBadVersionNumber{}):
+		kind = ErrKindRollback
+	case errors.Is(err, &metadata.ErrLengthOrHashMismatch{}), errors.Is(err, &metadata.ErrDownloadLengthMismatch{}):
+		kind = ErrKindLengthMismatch
+	case errors.As(err, &httpErr):
+		kind = ErrKindNetwork
+		if httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusForbidden {
+			kind = ErrKindNotFound
+		}
+	case errors.As(err, &netErr), errors.Is(err, &metadata.ErrDownload{}):
+		kind = ErrKindNetwork
+	case errors.Is(err, &metadata.ErrRepository{}), errors.Is(err, &metadata.ErrValue{}), errors.Is(err, &metadata.ErrType{}):
+		kind = ErrKindInvalidMetadata
+	}
+	return &Error{Kind: kind, Err: err}
+}
@@ -0,0 +1,182 @@
+package tuf
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+const defaultExpiryWarningHours = 72
+
+// RoleExpiry describes when the metadata of a role expires
+type RoleExpiry struct {
+	Role         string    `json:"role"`
+	Version      int64     `json:"version"`
+	Expires      time.Time `json:"expires"`
+	Expired      bool      `json:"expired"`
+	ExpiringSoon bool      `json:"expiringSoon"`
+}
+
+func (e RoleExpiry) String() string {
+	if e.Expired {
+		return fmt.Sprintf("%s metadata version %d expired at %s", e.Role, e.Version, e.Expires.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s metadata version %d expires at %s", e.Role, e.Version, e.Expires.Format(time.RFC3339))
+}
+
+// getExpiryWarningWindow returns how long before expiration a role is
+// reported as expiring soon, set with tuf.expiry_warning_hours
+func getExpiryWarningWindow(config *sotatoml.AppConfig) time.Duration {
+	hours, err := strconv.Atoi(config.GetDefault("tuf.expiry_warning_hours", strconv.Itoa(defaultExpiryWarningHours)))
+	if err != nil || hours < 0 {
+		hours = defaultExpiryWarningHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// newRoleExpiry tells whether a role is expired at now the way go-tuf does:
+// once now is after its expiration
+func newRoleExpiry(role string, version int64, expires time.Time, now time.Time, window time.Duration) RoleExpiry {
+	return RoleExpiry{
+		Role:         role,
+		Version:      version,
+		Expires:      expires,
+		Expired:      now.After(expires),
+		ExpiringSoon: now.Add(window).After(expires),
+	}
+}
+
+// GetMetadataExpiry returns the expiration of every trusted role, top-level
+// roles first. It is checked against the reference time refreshes use, so
+// that a role is reported as expired when a refresh would reject it.
+func (fiotuf *FioTuf) GetMetadataExpiry() []RoleExpiry {
+	ref := newRefClock(getTufPaths(fiotuf.config)).now()
+	return snapshotExpiry(fiotuf.getSnapshot(), ref.Time, getExpiryWarningWindow(fiotuf.config))
+}
+
+func snapshotExpiry(snapshot *tufSnapshot, now time.Time, window time.Duration) []RoleExpiry {
+	trusted := snapshot.trusted
+
+	ret := []RoleExpiry{newRoleExpiry(metadata.ROOT, trusted.Root.Signed.Version, trusted.Root.Signed.Expires, now, window)}
+	if trusted.Timestamp != nil {
+		ret = append(ret, newRoleExpiry(metadata.TIMESTAMP, trusted.Timestamp.Signed.Version, trusted.Timestamp.Signed.Expires, now, window))
+	}
+	if trusted.Snapshot != nil {
+		ret = append(ret, newRoleExpiry(metadata.SNAPSHOT, trusted.Snapshot.Signed.Version, trusted.Snapshot.Signed.Expires, now, window))
+	}
+	targets := trusted.Targets
+	if snapshot.targets != nil {
+		targets = snapshot.targets.roles
+	}
+	if md, ok := targets[metadata.TARGETS]; ok {
+		ret = append(ret, newRoleExpiry(metadata.TARGETS, md.Signed.Version, md.Signed.Expires, now, window))
+	}
+	var delegated []RoleExpiry
+	for role, md := range targets {
+		if role != metadata.TARGETS {
+			delegated = append(delegated, newRoleExpiry(role, md.Signed.Version, md.Signed.Expires, now, window))
+		}
+	}
+	sort.Slice(delegated, func(i, j int) bool { return delegated[i].Role < delegated[j].Role })
+	return append(ret, delegated...)
+}
+
+// GetExpiringRoles returns the trusted roles that are expired or about to
+func (fiotuf *FioTuf) GetExpiringRoles() []RoleExpiry {
+	var ret []RoleExpiry
+	for _, e := range fiotuf.GetMetadataExpiry() {
+		if e.ExpiringSoon {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// GetLocalMetadataExpiry reads the expiration of the metadata persisted in
+// the local metadata dir. Unlike GetMetadataExpiry it does not need network
+// access, and also lists roles that are already expired.
+func GetLocalMetadataExpiry(config *sotatoml.AppConfig) ([]RoleExpiry, error) {
+	paths := getTufPaths(config)
+	window := getExpiryWarningWindow(config)
+	now := newRefClock(paths).now().Time
+
+	files, err := filepath.Glob(filepath.Join(paths.metadataDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	order := map[string]int{metadata.ROOT: 0, metadata.TIMESTAMP: 1, metadata.SNAPSHOT: 2, metadata.TARGETS: 3}
+	var ret []RoleExpiry
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var md struct {
+			Signed struct {
+				Version int64     `json:"version"`
+				Expires time.Time `json:"expires"`
+			} `json:"signed"`
+		}
+		if err = json.Unmarshal(data, &md); err != nil {
+			return nil, err
+		}
+		role := strings.TrimSuffix(filepath.Base(file), ".json")
+		if unescaped, err := url.PathUnescape(role); err == nil {
+			role = unescaped
+		}
+		ret = append(ret, newRoleExpiry(role, md.Signed.Version, md.Signed.Expires, now, window))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		oi, iTop := order[ret[i].Role]
+		oj, jTop := order[ret[j].Role]
+		if iTop != jTop {
+			return iTop
+		}
+		if iTop {
+			return oi < oj
+		}
+		return ret[i].Role < ret[j].Role
+	})
+	return ret, nil
+}
+
+// ExpiryWarner logs a warning for every role about to expire, and calls
+// notify once per role version so that callers can report it upstream
+type ExpiryWarner struct {
+	mu     sync.Mutex
+	warned map[string]int64
+	notify func(RoleExpiry)
+}
+
+func NewExpiryWarner(notify func(RoleExpiry)) *ExpiryWarner {
+	return &ExpiryWarner{warned: map[string]int64{}, notify: notify}
+}
+
+func (w *ExpiryWarner) Check(expiry []RoleExpiry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, e := range expiry {
+		if !e.ExpiringSoon {
+			continue
+		}
+		log.Println("WARNING:", e)
+		if version, ok := w.warned[e.Role]; ok && version == e.Version {
+			continue
+		}
+		w.warned[e.Role] = e.Version
+		if w.notify != nil {
+			w.notify(e)
+		}
+	}
+}
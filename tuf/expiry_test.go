@@ -0,0 +1,58 @@
+package tuf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+func findExpiry(expiry []RoleExpiry, role string) *RoleExpiry {
+	for i := range expiry {
+		if expiry[i].Role == role {
+			return &expiry[i]
+		}
+	}
+	return nil
+}
+
+func TestMetadataExpiryUsesReferenceTime(t *testing.T) {
+	// the test timestamp metadata expires in a day
+	fiotuf, _ := newTestFioTuf(t, `expiry_warning_hours = "10"`)
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if e := findExpiry(fiotuf.GetMetadataExpiry(), metadata.TIMESTAMP); e == nil || e.ExpiringSoon {
+		t.Fatalf("expected the timestamp not to be expiring soon, got %+v", e)
+	}
+
+	// a last known good time after the system clock means the system clock
+	// went back, refreshes then use the former
+	lastKnownGood := time.Now().UTC().Add(20 * time.Hour).Format(time.RFC3339)
+	path := filepath.Join(getTufPaths(fiotuf.config).metadataDir, lastKnownGoodTimeFile)
+	if err := os.WriteFile(path, []byte(lastKnownGood), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if ref := fiotuf.GetRefreshStatus().LastSuccess.ReferenceTime; ref == nil || ref.Source != TimeSourceLastKnownGood {
+		t.Fatalf("expected the refresh to use the last known good time, got %+v", ref)
+	}
+
+	local, err := GetLocalMetadataExpiry(fiotuf.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expiry := range map[string][]RoleExpiry{"trusted": fiotuf.GetMetadataExpiry(), "local": local} {
+		if e := findExpiry(expiry, metadata.TIMESTAMP); e == nil || !e.ExpiringSoon || e.Expired {
+			t.Errorf("expected the %s timestamp to be expiring soon, got %+v", name, e)
+		}
+		if e := findExpiry(expiry, metadata.TARGETS); e == nil || e.ExpiringSoon {
+			t.Errorf("expected the %s targets not to be expiring soon, got %+v", name, e)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package tuf
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// ExportBundle writes the metadata trusted by this device to the repo
+// directory of bundlePath, in the layout expected by RefreshTuf for offline
+// bundles: the chain of root versions from the local root store, then the
+// timestamp, snapshot, targets and delegated targets metadata. The exported
+// bundle is verified against the device's trusted metadata once written.
+func ExportBundle(config *sotatoml.AppConfig, bundlePath string) (*BundleReport, error) {
+	paths := getTufPaths(config)
+	repoPath := BundleRepoPath(bundlePath)
+	if err := os.MkdirAll(repoPath, 0o755); err != nil {
+		return nil, err
+	}
+
+	root, err := metadata.Root().FromFile(filepath.Join(paths.metadataDir, "root.json"))
+	if err != nil {
+		return nil, &Error{Kind: ErrKindNoInitialRoot, Err: err}
+	}
+	for version := int64(1); version <= root.Signed.Version; version++ {
+		data, err := readRoot(paths, version)
+		if err != nil {
+			// devices provisioned before the root store existed lack old versions
+			log.Printf("Not exporting root version %d: %s", version, err)
+			continue
+		}
+		if err = writeBundleFile(repoPath, fmt.Sprintf("%d.root.json", version), data); err != nil {
+			return nil, err
+		}
+	}
+	if err = copyBundleFile(paths.metadataDir, repoPath, "root.json", "root.json"); err != nil {
+		return nil, err
+	}
+	if err = copyBundleFile(paths.metadataDir, repoPath, "timestamp.json", "timestamp.json"); err != nil {
+		return nil, err
+	}
+
+	// the snapshot lists the version of every targets role
+	snapshot, err := metadata.Snapshot().FromFile(filepath.Join(paths.metadataDir, "snapshot.json"))
+	if err != nil {
+		return nil, err
+	}
+	prefix := func(version int64) string {
+		if root.Signed.ConsistentSnapshot {
+			return strconv.FormatInt(version, 10) + "."
+		}
+		return ""
+	}
+	if err = copyBundleFile(paths.metadataDir, repoPath, "snapshot.json", prefix(snapshot.Signed.Version)+"snapshot.json"); err != nil {
+		return nil, err
+	}
+	for name, meta := range snapshot.Signed.Meta {
+		role := strings.TrimSuffix(name, ".json")
+		src := url.PathEscape(role) + ".json"
+		if _, err := os.Stat(filepath.Join(paths.metadataDir, src)); err != nil {
+			// delegated roles are only loaded when reachable
+			log.Printf("Not exporting %s metadata: %s", role, err)
+			continue
+		}
+		if err = copyBundleFile(paths.metadataDir, repoPath, src, prefix(meta.Version)+src); err != nil {
+			return nil, err
+		}
+	}
+
+	return VerifyBundle(config, bundlePath)
+}
+
+func copyBundleFile(srcDir string, dstDir string, src string, dst string) error {
+	data, err := os.ReadFile(filepath.Join(srcDir, src))
+	if err != nil {
+		return err
+	}
+	return writeBundleFile(dstDir, dst, data)
+}
+
+func writeBundleFile(dir string, name string, data []byte) error {
+	return os.WriteFile(filepath.Join(dir, name), data, 0o644)
+}
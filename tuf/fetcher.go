@@ -0,0 +1,380 @@
+package tuf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+type FioFetcher struct {
+	client  *http.Client
+	tag     string
+	repoUrl string
+	mirrors []string
+	retries int
+	// timeout replaces the per-request deadline given by callers, if set
+	timeout time.Duration
+	// ctx stops downloads and the delays between retries once done. go-tuf
+	// does not pass a context to fetchers, so it is set for each refresh.
+	ctx context.Context
+
+	// onGatewayResponse is called with the responses received from URLs
+	// starting with gatewayUrl, whatever their status
+	gatewayUrl        string
+	onGatewayResponse func(*http.Response)
+	// onFetch is called with the metadata downloaded so far when a role
+	// is about to be fetched
+	onFetch func(role string, bytesDownloaded int64)
+
+	mu      sync.Mutex
+	sources map[string]string
+	// roots holds every root metadata file downloaded, in order
+	roots [][]byte
+	stats TransferStats
+
+	// cache is used for conditional requests, if set
+	cache *httpCache
+}
+
+// newFioFetcher creates a fetcher for the given mirrors. The first mirror is
+// the one go-tuf builds URLs for; the other ones are only used as fallback.
+func newFioFetcher(client *http.Client, tag string, mirrors []string, retries int) *FioFetcher {
+	return &FioFetcher{
+		client:  client,
+		ctx:     context.Background(),
+		tag:     tag,
+		repoUrl: mirrors[0],
+		mirrors: mirrors,
+		retries: retries,
+		sources: map[string]string{},
+		stats:   TransferStats{BytesByRole: map[string]int64{}},
+	}
+}
+
+// DownloadFile downloads a file from urlPath, errors out if it failed,
+// its length is larger than maxLength or the timeout is reached.
+// Retryable failures are retried with backoff, then the next mirror is tried.
+// Other failures move to the next mirror right away, except a 404 for a
+// root version, which tells go-tuf there is no newer root.
+func (d *FioFetcher) DownloadFile(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	if d.timeout > 0 {
+		timeout = d.timeout
+	}
+	relPath, ok := strings.CutPrefix(urlPath, d.repoUrl)
+	if !ok {
+		return d.downloadWithRetry(urlPath, maxLength, timeout)
+	}
+
+	role, version := parseMetadataPath(relPath)
+	if d.onFetch != nil {
+		d.onFetch(role, d.Stats().BytesDownloaded)
+	}
+	var err error
+	for _, mirror := range d.mirrors {
+		var data []byte
+		data, err = d.downloadWithRetry(mirror+relPath, maxLength, timeout)
+		if err == nil {
+			d.mu.Lock()
+			d.sources[role] = mirror
+			if role == metadata.ROOT {
+				d.roots = append(d.roots, data)
+			}
+			d.mu.Unlock()
+			return data, nil
+		}
+		if role == metadata.ROOT && version > 0 && isNotFound(err) {
+			return nil, err
+		}
+		if d.ctx.Err() != nil {
+			// the refresh is interrupted, do not try the next mirrors
+			return nil, err
+		}
+		log.Printf("Unable to fetch %s from %s: %s", relPath, mirror, err)
+	}
+	return nil, err
+}
+
+// Sources returns the mirror each role was last fetched from
+func (d *FioFetcher) Sources() map[string]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return maps.Clone(d.sources)
+}
+
+// Stats returns the metadata transferred from remote repositories so far
+func (d *FioFetcher) Stats() TransferStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := d.stats
+	stats.BytesByRole = maps.Clone(d.stats.BytesByRole)
+	return stats
+}
+
+// SaveCache persists the validators of the responses received so far
+func (d *FioFetcher) SaveCache() error {
+	if d.cache == nil {
+		return nil
+	}
+	return d.cache.save()
+}
+
+// Roots returns the root metadata files downloaded so far. They have not
+// necessarily been verified.
+func (d *FioFetcher) Roots() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.roots)
+}
+
+func (d *FioFetcher) downloadWithRetry(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := d.download(urlPath, maxLength, timeout)
+		if err == nil || !isRetryable(err) || attempt >= d.retries {
+			return data, err
+		}
+		delay := backoffDelay(attempt, err)
+		log.Printf("Fetching %s failed (%s), retrying in %s", urlPath, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			return nil, &errNetwork{fmt.Sprintf("download of %s interrupted: %s", urlPath, err), d.ctx.Err()}
+		}
+	}
+}
+
+func (d *FioFetcher) download(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	if strings.HasPrefix(urlPath, "file://") {
+		return readLocalFile(urlPath[len("file://"):], maxLength)
+	} else {
+		return readRemoteFile(d, urlPath, maxLength, timeout)
+	}
+}
+
+// backoffDelay returns an exponential backoff delay with full jitter, unless
+// the server asked for a specific delay
+func backoffDelay(attempt int, err error) time.Duration {
+	var retryAfter *errRetryAfter
+	if errors.As(err, &retryAfter) && retryAfter.delay > 0 {
+		return min(retryAfter.delay, retryMaxDelay)
+	}
+	delay := retryMaxDelay
+	if attempt < 5 {
+		delay = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return time.Duration(rand.Int64N(int64(delay))) + time.Millisecond
+}
+
+// isRetryable tells if a download error is likely to be transient
+func isRetryable(err error) bool {
+	var retryAfter *errRetryAfter
+	var httpErr *metadata.ErrDownloadHTTP
+	var netErr *errNetwork
+	switch {
+	case errors.As(err, &retryAfter):
+		return true
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode >= 500
+	case errors.As(err, &netErr):
+		return true
+	}
+	return false
+}
+
+// isNotFound tells if a download failed with a 404
+func isNotFound(err error) bool {
+	var httpErr *metadata.ErrDownloadHTTP
+	return errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNotFound
+}
+
+// errNetwork is returned when a request could not be completed
+type errNetwork struct {
+	msg string
+	err error
+}
+
+func (e *errNetwork) Error() string {
+	return e.msg
+}
+
+func (e *errNetwork) Unwrap() error {
+	return e.err
+}
+
+// errRetryAfter is returned for "429 Too Many Requests" responses
+type errRetryAfter struct {
+	err   *metadata.ErrDownloadHTTP
+	delay time.Duration
+}
+
+func (e *errRetryAfter) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.err, e.delay)
+}
+
+func (e *errRetryAfter) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses a Retry-After header, either in seconds or as an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func readLocalFile(filePath string, maxLength int64) ([]byte, error) {
+	log.Println("Reading local file:", filePath)
+	f, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		// go-tuf relies on a 404 to detect there is no newer root version
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: http.StatusNotFound, URL: "file://" + filePath}
+	} else if err != nil {
+		return nil, &Error{Kind: ErrKindBundleUnreadable, Err: err}
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxLength+1))
+	if err != nil {
+		return nil, &Error{Kind: ErrKindBundleUnreadable, Err: err}
+	}
+	if err = checkLength(data, "file://"+filePath, maxLength); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readRemoteFile(d *FioFetcher, urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
+	log.Println("Fetching remote file: " + urlPath)
+	ctx := d.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "fiotuf-client/1")
+	req.Header.Set("x-ats-tags", d.tag)
+
+	var cached []byte
+	if d.cache != nil {
+		var entry httpCacheEntry
+		var ok bool
+		if entry, cached, ok = d.cache.lookup(urlPath); ok {
+			if entry.ETag != "" {
+				req.Header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				req.Header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+	}
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, downloadError(urlPath, timeout, err)
+	}
+	defer res.Body.Close()
+	d.mu.Lock()
+	d.stats.Requests++
+	d.mu.Unlock()
+
+	if d.onGatewayResponse != nil && d.gatewayUrl != "" && strings.HasPrefix(urlPath, d.gatewayUrl) {
+		d.onGatewayResponse(res)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, &errRetryAfter{
+			err:   &metadata.ErrDownloadHTTP{StatusCode: res.StatusCode, URL: urlPath},
+			delay: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
+	if res.StatusCode == http.StatusNotModified && cached != nil {
+		if err = checkLength(cached, urlPath, maxLength); err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		d.stats.NotModified++
+		d.stats.BytesSaved += int64(len(cached))
+		d.mu.Unlock()
+		return cached, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &metadata.ErrDownloadHTTP{StatusCode: res.StatusCode, URL: urlPath}
+	}
+
+	// Get content length from header (might not be accurate, -1 or not set).
+	if header := res.Header.Get("Content-Length"); header != "" {
+		length, err := strconv.ParseInt(header, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		// Error if the reported size is greater than what is expected.
+		if length > maxLength {
+			return nil, &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("download failed for %s, length %d is larger than expected %d", urlPath, length, maxLength)}
+		}
+	}
+
+	// Although the size has been checked above, use a LimitReader in case
+	// the reported size is inaccurate, or size is -1 which indicates an
+	// unknown length. We read maxLength + 1 in order to check if the read data
+	// surpassed our set limit.
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxLength+1))
+	d.mu.Lock()
+	d.stats.BytesDownloaded += int64(len(data))
+	d.stats.BytesByRole[roleFromPath(urlPath)] += int64(len(data))
+	d.mu.Unlock()
+	if err != nil {
+		return nil, downloadError(urlPath, timeout, err)
+	}
+	if err = checkLength(data, urlPath, maxLength); err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		d.cache.store(urlPath, res.Header.Get("ETag"), res.Header.Get("Last-Modified"), data)
+	}
+	return data, nil
+}
+
+func checkLength(data []byte, urlPath string, maxLength int64) error {
+	if int64(len(data)) > maxLength {
+		return &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("download failed for %s, length is larger than expected %d", urlPath, maxLength)}
+	}
+	return nil
+}
+
+// downloadError gives a clearer message for downloads aborted by the
+// per-request deadline, keeping the original error wrapped
+func downloadError(urlPath string, timeout time.Duration, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &errNetwork{fmt.Sprintf("download of %s timed out after %s: %s", urlPath, timeout, err), err}
+	}
+	return &errNetwork{fmt.Sprintf("download of %s failed: %s", urlPath, err), err}
+}
@@ -0,0 +1,309 @@
+package tuf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// flakyServer fails the first failures requests with status, then serves
+// body. It counts the requests it received.
+func flakyServer(t *testing.T, failures int32, status int, header http.Header, body string) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// closedUrl returns the URL of a server that refuses connections
+func closedUrl(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func TestDownloadRetriesServerErrors(t *testing.T) {
+	server, requests := flakyServer(t, 1, http.StatusServiceUnavailable, nil, "{}")
+	fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 1)
+
+	data, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", 1024, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{}" || requests.Load() != 2 {
+		t.Errorf("expected a successful retry, got %q after %d requests", data, requests.Load())
+	}
+}
+
+func TestDownloadGivesUpAfterRetries(t *testing.T) {
+	server, requests := flakyServer(t, 10, http.StatusInternalServerError, nil, "{}")
+	fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 1)
+
+	_, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", 1024, time.Second)
+	var httpErr *metadata.ErrDownloadHTTP
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the server error, got %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestDownloadHonorsRetryAfter(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"1"}}
+	server, requests := flakyServer(t, 1, http.StatusTooManyRequests, header, "{}")
+	fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 1)
+
+	start := time.Now()
+	if _, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", 1024, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected to wait for the Retry-After delay, retried after %s", elapsed)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+}
+
+func TestDownloadInterruptedDuringRetryDelay(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"30"}}
+	server, requests := flakyServer(t, 1, http.StatusTooManyRequests, header, "{}")
+	fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	fetcher.ctx = ctx
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", 1024, time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the download to be interrupted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the retry delay to be interrupted, returned after %s", elapsed)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected a single request, got %d", n)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	retryAfter := &errRetryAfter{err: &metadata.ErrDownloadHTTP{StatusCode: http.StatusTooManyRequests}, delay: 5 * time.Second}
+	if delay := backoffDelay(0, retryAfter); delay != 5*time.Second {
+		t.Errorf("expected the Retry-After delay, got %s", delay)
+	}
+	retryAfter.delay = time.Hour
+	if delay := backoffDelay(0, retryAfter); delay != retryMaxDelay {
+		t.Errorf("expected the Retry-After delay to be capped, got %s", delay)
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		if delay := backoffDelay(attempt, errors.New("failed")); delay <= 0 || delay > retryMaxDelay+time.Millisecond {
+			t.Errorf("unexpected delay %s for attempt %d", delay, attempt)
+		}
+	}
+}
+
+func TestDownloadFallsBackOnConnectionError(t *testing.T) {
+	server, _ := flakyServer(t, 0, 0, nil, "{}")
+	down := closedUrl(t) + "/repo"
+	fetcher := newFioFetcher(server.Client(), "", []string{down, server.URL + "/repo"}, 0)
+
+	data, err := fetcher.DownloadFile(down+"/timestamp.json", 1024, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{}" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if source := fetcher.Sources()[metadata.TIMESTAMP]; source != server.URL+"/repo" {
+		t.Errorf("expected timestamp to come from the second mirror, got %q", source)
+	}
+}
+
+func TestDownloadFallsBackOnNotFound(t *testing.T) {
+	lan, _ := flakyServer(t, 10, http.StatusNotFound, nil, "")
+	gateway, requests := flakyServer(t, 0, 0, nil, "{}")
+	fetcher := newFioFetcher(http.DefaultClient, "", []string{lan.URL + "/repo", gateway.URL + "/repo"}, 0)
+
+	if _, err := fetcher.DownloadFile(lan.URL+"/repo/timestamp.json", 1024, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if source := fetcher.Sources()[metadata.TIMESTAMP]; source != gateway.URL+"/repo" {
+		t.Errorf("expected timestamp to come from the second mirror, got %q", source)
+	}
+
+	// a missing root version means there is no newer root
+	_, err := fetcher.DownloadFile(lan.URL+"/repo/2.root.json", 1024, time.Second)
+	if !isNotFound(err) {
+		t.Errorf("expected a 404 for the root version probe, got %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected the root version probe to stop at the first mirror, got %d requests to the second", n)
+	}
+}
+
+func TestRefreshReportsSources(t *testing.T) {
+	repo := tuftest.NewRepo(t)
+	gateway, _ := flakyServer(t, 1000, http.StatusServiceUnavailable, nil, "")
+	mirror := httptest.NewServer(repo.Handler())
+	t.Cleanup(mirror.Close)
+	config := tuftest.NewConfig(t, repo, gateway.URL, `mirrors = "`+mirror.URL+`/repo"`)
+	fiotuf, err := NewFioTuf(config, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	result := fiotuf.GetRefreshStatus().LastSuccess
+	for _, role := range []string{metadata.TIMESTAMP, metadata.SNAPSHOT, metadata.TARGETS} {
+		if result == nil || result.Sources[role] != mirror.URL+"/repo" {
+			t.Errorf("expected the mirror to be reported as the source of %s, got %+v", role, result)
+		}
+	}
+}
+
+func TestDownloadLengthLimit(t *testing.T) {
+	const maxLength = 1024
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr bool
+	}{
+		{
+			name: "within limit",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(make([]byte, maxLength))
+			},
+		},
+		{
+			name: "Content-Length over limit",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(make([]byte, maxLength+1))
+			},
+			wantErr: true,
+		},
+		{
+			name: "no Content-Length, body over limit",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 4; i++ {
+					w.Write(make([]byte, maxLength/2))
+					w.(http.Flusher).Flush()
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "lying Content-Length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				conn, buf, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer conn.Close()
+				buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 16\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n")
+				fmt.Fprintf(buf, "%x\r\n%s\r\n0\r\n\r\n", 2*maxLength, make([]byte, 2*maxLength))
+				buf.Flush()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			t.Cleanup(server.Close)
+			fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 0)
+
+			data, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", maxLength, time.Second)
+			if !tt.wantErr {
+				if err != nil || len(data) != maxLength {
+					t.Errorf("expected %d bytes, got %d, %v", maxLength, len(data), err)
+				}
+				return
+			}
+			var lengthErr *metadata.ErrDownloadLengthMismatch
+			if !errors.As(err, &lengthErr) {
+				t.Errorf("expected a length mismatch, got %d bytes, %v", len(data), err)
+			}
+			if n := fetcher.Stats().BytesDownloaded; n > maxLength+1 {
+				t.Errorf("expected at most %d bytes to be read, got %d", maxLength+1, n)
+			}
+		})
+	}
+}
+
+func TestDownloadDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		// stall is called once the server stalls, until the request is
+		// aborted
+		handler func(w http.ResponseWriter, stall func())
+	}{
+		{
+			name: "before headers",
+			handler: func(w http.ResponseWriter, stall func()) {
+				stall()
+			},
+		},
+		{
+			name: "during body",
+			handler: func(w http.ResponseWriter, stall func()) {
+				w.Header().Set("Content-Length", "512")
+				w.Write(make([]byte, 256))
+				w.(http.Flusher).Flush()
+				stall()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(w, func() {
+					select {
+					case <-r.Context().Done():
+					case <-done:
+					}
+				})
+			}))
+			t.Cleanup(server.Close)
+			t.Cleanup(func() { close(done) })
+			fetcher := newFioFetcher(server.Client(), "", []string{server.URL + "/repo"}, 0)
+
+			start := time.Now()
+			_, err := fetcher.DownloadFile(server.URL+"/repo/timestamp.json", 1024, 100*time.Millisecond)
+			var netErr *errNetwork
+			if !errors.As(err, &netErr) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected a network error wrapping the deadline, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("expected the download to be aborted at its deadline, took %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package tuf
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// targetCustom holds the custom metadata fields used to match targets
+// against this device
+type targetCustom struct {
+	Version     string   `json:"version"`
+	HardwareIds []string `json:"hardwareIds"`
+	Tags        []string `json:"tags"`
+}
+
+func parseTargetCustom(target *metadata.TargetFiles) targetCustom {
+	var tc targetCustom
+	if target.Custom != nil {
+		_ = json.Unmarshal(*target.Custom, &tc)
+	}
+	return tc
+}
+
+// GetTags returns the tags this device follows, set with pacman.tags, in
+// order of priority
+func GetTags(config *sotatoml.AppConfig) []string {
+	var tags []string
+	for _, tag := range strings.Split(config.GetDefault("pacman.tags", ""), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// FilterByTags returns the targets having the first of the given tags that
+// any target has, so that the order of tags sets their priority. All targets
+// are returned if no tag is given.
+func FilterByTags(targets map[string]*metadata.TargetFiles, tags []string) map[string]*metadata.TargetFiles {
+	if len(tags) == 0 {
+		return targets
+	}
+	for _, tag := range tags {
+		ret := map[string]*metadata.TargetFiles{}
+		for name, target := range targets {
+			if slices.Contains(parseTargetCustom(target).Tags, tag) {
+				ret[name] = target
+			}
+		}
+		if len(ret) > 0 {
+			return ret
+		}
+	}
+	return map[string]*metadata.TargetFiles{}
+}
+
+// GetHardwareId returns the hardware ID of this device, set with
+// provision.primary_ecu_hardware_id
+func GetHardwareId(config *sotatoml.AppConfig) string {
+	return config.GetDefault("provision.primary_ecu_hardware_id", "")
+}
+
+// MatchesHardwareId tells if a target lists the given hardware ID in its
+// custom "hardwareIds". Any target matches if hwid is empty.
+func MatchesHardwareId(target *metadata.TargetFiles, hwid string) bool {
+	return parseTargetCustom(target).matchesHardwareId(hwid)
+}
+
+// FilterByHardwareId returns the targets that can be installed on the given
+// hardware
+func FilterByHardwareId(targets map[string]*metadata.TargetFiles, hwid string) map[string]*metadata.TargetFiles {
+	ret := map[string]*metadata.TargetFiles{}
+	for name, target := range targets {
+		if MatchesHardwareId(target, hwid) {
+			ret[name] = target
+		}
+	}
+	return ret
+}
+
+// matchesTags tells if a target has one of the given tags. Any target
+// matches if no tag is set.
+func (tc targetCustom) matchesTags(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tc.Tags {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHardwareId tells if a target can be installed on the given hardware.
+// Any target matches if the hardware ID is not set.
+func (tc targetCustom) matchesHardwareId(hwid string) bool {
+	return hwid == "" || slices.Contains(tc.HardwareIds, hwid)
+}
@@ -0,0 +1,100 @@
+package tuf
+
+import (
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+const (
+	// mirrorGateway can be used in tuf.mirrors to set the position of the
+	// device gateway in the list
+	mirrorGateway = "gateway"
+
+	defaultFetchRetries = 3
+	// defaultFetchTimeout is the per-request deadline go-tuf gives for the
+	// metadata it fetches
+	defaultFetchTimeout = 15 * time.Second
+)
+
+// getMirrors returns the ordered list of repository base URLs metadata is
+// fetched from. It is set in sota.toml as a comma separated list:
+//
+//	[tuf]
+//	mirrors = "gateway,http://192.168.1.10:9081/repo,/media/usb/repo"
+//
+// Entries without a scheme are local paths. The device gateway is tried
+// first unless "gateway" is explicitly placed elsewhere in the list.
+func getMirrors(config *sotatoml.AppConfig) []string {
+	gateway := gatewayRepoUrl(config)
+	mirrors := []string{}
+	hasGateway := false
+	for _, m := range strings.Split(config.Get("tuf.mirrors"), ",") {
+		m = strings.TrimSuffix(strings.TrimSpace(m), "/")
+		switch {
+		case m == "":
+			continue
+		case m == mirrorGateway:
+			m = gateway
+			hasGateway = true
+		case !strings.Contains(m, "://"):
+			m = "file://" + m
+		}
+		mirrors = append(mirrors, m)
+	}
+	if !hasGateway {
+		mirrors = append([]string{gateway}, mirrors...)
+	}
+	return mirrors
+}
+
+func gatewayRepoUrl(config *sotatoml.AppConfig) string {
+	return config.GetDefault("tls.server", "https://ota-lite.foundries.io:8443") + "/repo"
+}
+
+func getFetchRetries(config *sotatoml.AppConfig) int {
+	val := config.GetDefault("tuf.fetch_retries", strconv.Itoa(defaultFetchRetries))
+	retries, err := strconv.Atoi(val)
+	if err != nil || retries < 0 {
+		log.Printf("Invalid tuf.fetch_retries value %q, using %d", val, defaultFetchRetries)
+		return defaultFetchRetries
+	}
+	return retries
+}
+
+func getFetchTimeout(config *sotatoml.AppConfig) time.Duration {
+	val := config.GetDefault("tuf.fetch_timeout_sec", strconv.Itoa(int(defaultFetchTimeout.Seconds())))
+	sec, err := strconv.Atoi(val)
+	if err != nil || sec <= 0 {
+		log.Printf("Invalid tuf.fetch_timeout_sec value %q, using %s", val, defaultFetchTimeout)
+		return defaultFetchTimeout
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// roleFromPath extracts the role name from a metadata file path, like
+// "/3.snapshot.json" or "/timestamp.json"
+func roleFromPath(relPath string) string {
+	role, _ := parseMetadataPath(relPath)
+	return role
+}
+
+// parseMetadataPath returns the role and version of a metadata file path,
+// like ".../3.targets.json". The version is 0 if the path has none.
+func parseMetadataPath(relPath string) (string, int64) {
+	name := relPath[strings.LastIndex(relPath, "/")+1:]
+	name = strings.TrimSuffix(name, ".json")
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	if prefix, role, found := strings.Cut(name, "."); found {
+		if version, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			return role, version
+		}
+	}
+	return name, 0
+}
@@ -0,0 +1,59 @@
+package tuf
+
+import (
+	"slices"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// RefreshPhase is the step a running refresh is at
+type RefreshPhase string
+
+const (
+	PhaseRoot      RefreshPhase = "fetching-root"
+	PhaseTimestamp RefreshPhase = "fetching-timestamp"
+	PhaseSnapshot  RefreshPhase = "fetching-snapshot"
+	// PhaseTargets covers the top-level and delegated targets metadata
+	PhaseTargets RefreshPhase = "fetching-targets"
+)
+
+// RefreshProgress is reported each time a running refresh fetches a
+// metadata file
+type RefreshProgress struct {
+	// Source is the local repository path, or empty for the device gateway
+	Source string       `json:"source,omitempty"`
+	Phase  RefreshPhase `json:"phase"`
+	Role   string       `json:"role"`
+	// BytesDownloaded counts the metadata downloaded by the refresh so far
+	BytesDownloaded int64 `json:"bytesDownloaded"`
+}
+
+func phaseOf(role string) RefreshPhase {
+	switch role {
+	case metadata.ROOT:
+		return PhaseRoot
+	case metadata.TIMESTAMP:
+		return PhaseTimestamp
+	case metadata.SNAPSHOT:
+		return PhaseSnapshot
+	}
+	return PhaseTargets
+}
+
+// AddProgressListener registers a function to be called as running
+// refreshes fetch metadata
+func (fiotuf *FioTuf) AddProgressListener(fn func(RefreshProgress)) {
+	fiotuf.mu.Lock()
+	defer fiotuf.mu.Unlock()
+	fiotuf.progressListeners = append(fiotuf.progressListeners, fn)
+}
+
+func (fiotuf *FioTuf) notifyProgress(progress RefreshProgress) {
+	fiotuf.mu.RLock()
+	listeners := slices.Clone(fiotuf.progressListeners)
+	fiotuf.mu.RUnlock()
+
+	for _, fn := range listeners {
+		fn(progress)
+	}
+}
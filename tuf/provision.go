@@ -0,0 +1,161 @@
+package tuf
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+const (
+	DeviceTypeAuto = "auto"
+	DeviceTypeCi   = "ci"
+	DeviceTypeProd = "prod"
+)
+
+// tufPaths holds the TUF storage and provisioning settings read from sota.toml:
+//
+//	[tuf]
+//	path = "/var/sota/tuf"                 # defaults to <storage.path>/tuf
+//	provision_path = "/usr/lib/sota/tuf"   # initial root metadata shipped with the image
+//	device_type = "auto"                   # "ci", "prod" or "auto"
+//
+// With "auto", the device type is read from the client certificate set
+// with import.tls_clientcert_path. Without a readable certificate, the only
+// provisioned type is used, and "ci" if both are.
+type tufPaths struct {
+	metadataDir    string
+	provisionDir   string
+	deviceType     string
+	clientCertPath string
+}
+
+func getTufPaths(config *sotatoml.AppConfig) tufPaths {
+	storagePath := config.GetDefault("storage.path", "/var/sota")
+	return tufPaths{
+		metadataDir:    config.GetDefault("tuf.path", filepath.Join(storagePath, "tuf")),
+		provisionDir:   config.GetDefault("tuf.provision_path", "/usr/lib/sota/tuf"),
+		deviceType:     config.GetDefault("tuf.device_type", DeviceTypeAuto),
+		clientCertPath: config.GetDefault("import.tls_clientcert_path", ""),
+	}
+}
+
+// oidBusinessCategory is the certificate subject attribute set to
+// "production" for devices registered as production ones
+var oidBusinessCategory = asn1.ObjectIdentifier{2, 5, 4, 15}
+
+// detectDeviceType tells whether the device is a production one from the
+// subject of its client certificate
+func detectDeviceType(certPath string) (string, error) {
+	if certPath == "" {
+		return "", errors.New("no client certificate file configured")
+	}
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("no PEM data in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidBusinessCategory) && name.Value == "production" {
+			return DeviceTypeProd, nil
+		}
+	}
+	return DeviceTypeCi, nil
+}
+
+// ImportedRoot describes the initial root metadata imported from the
+// provisioning directory
+type ImportedRoot struct {
+	Path       string `json:"path"`
+	DeviceType string `json:"deviceType"`
+	Version    int    `json:"version"`
+}
+
+// importInitialRoot copies the latest provisioned root metadata into the
+// local metadata dir, if there is no trusted root there yet. It returns nil
+// if nothing had to be imported.
+func importInitialRoot(paths tufPaths) (*ImportedRoot, error) {
+	rootPath := filepath.Join(paths.metadataDir, "root.json")
+	if _, err := os.Stat(rootPath); !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	log.Printf("%s does not exist. Trying to import initial root metadata\n", rootPath)
+
+	deviceTypes := []string{paths.deviceType}
+	if paths.deviceType == DeviceTypeAuto {
+		if deviceType, err := detectDeviceType(paths.clientCertPath); err == nil {
+			log.Printf("Detected %s device from its client certificate", deviceType)
+			deviceTypes = []string{deviceType}
+		} else {
+			log.Printf("Unable to detect the device type from its client certificate: %s", err)
+			deviceTypes = []string{DeviceTypeProd, DeviceTypeCi}
+		}
+	}
+
+	var found []*ImportedRoot
+	for _, deviceType := range deviceTypes {
+		path, version := findLatestRoot(filepath.Join(paths.provisionDir, deviceType))
+		if path != "" {
+			found = append(found, &ImportedRoot{Path: path, DeviceType: deviceType, Version: version})
+		}
+	}
+	if len(found) == 0 {
+		msg := "unable to find initial root metadata"
+		log.Println(msg)
+		return nil, &Error{Kind: ErrKindNoInitialRoot, Err: errors.New(msg)}
+	}
+	imported := found[0]
+	if len(found) > 1 {
+		// the default before the device type could be detected
+		imported = found[slices.IndexFunc(found, func(r *ImportedRoot) bool { return r.DeviceType == DeviceTypeCi })]
+		log.Println("Both ci and prod initial root metadata are provisioned and the device type is unknown, using ci; set tuf.device_type to change it")
+	}
+
+	log.Printf("Importing %s (%s, version %d)", imported.Path, imported.DeviceType, imported.Version)
+	rootBytes, err := os.ReadFile(imported.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(paths.metadataDir, 0o755); err != nil {
+		return nil, err
+	}
+	if err = sotatoml.SafeWrite(rootPath, rootBytes); err != nil {
+		return nil, err
+	}
+	if err = saveRoot(paths, int64(imported.Version), rootBytes); err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// findLatestRoot returns the path and version of the latest <N>.root.json
+// file in a sequence starting from 1.root.json
+func findLatestRoot(dir string) (string, int) {
+	existingRootPath := ""
+	version := 0
+	for i := 1; i < 100; i++ {
+		importRootPath := filepath.Join(dir, strconv.Itoa(i)+".root.json")
+		if _, err := os.Stat(importRootPath); errors.Is(err, os.ErrNotExist) {
+			log.Printf("%s does not exist\n", importRootPath)
+			break
+		}
+		existingRootPath = importRootPath
+		version = i
+	}
+	return existingRootPath, version
+}
@@ -0,0 +1,227 @@
+package tuf
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+func loadTestConfig(t *testing.T, toml string) *sotatoml.AppConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sota.toml")
+	if err := os.WriteFile(path, []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := sotatoml.NewAppConfig([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestGetTufPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want tufPaths
+	}{
+		{
+			name: "defaults",
+			toml: "[storage]\ntype = \"sqlite\"\n",
+			want: tufPaths{
+				metadataDir:  "/var/sota/tuf",
+				provisionDir: "/usr/lib/sota/tuf",
+				deviceType:   DeviceTypeAuto,
+			},
+		},
+		{
+			name: "storage path",
+			toml: "[storage]\npath = \"/data/sota\"\n",
+			want: tufPaths{
+				metadataDir:  "/data/sota/tuf",
+				provisionDir: "/usr/lib/sota/tuf",
+				deviceType:   DeviceTypeAuto,
+			},
+		},
+		{
+			name: "tuf settings",
+			toml: `[storage]
+path = "/data/sota"
+
+[import]
+tls_clientcert_path = "/data/sota/client.pem"
+
+[tuf]
+path = "/data/tuf"
+provision_path = "/etc/tuf"
+device_type = "prod"
+`,
+			want: tufPaths{
+				metadataDir:    "/data/tuf",
+				provisionDir:   "/etc/tuf",
+				deviceType:     DeviceTypeProd,
+				clientCertPath: "/data/sota/client.pem",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getTufPaths(loadTestConfig(t, tt.toml)); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// writeClientCert writes a self-signed certificate with the given subject
+func writeClientCert(t *testing.T, subject pkix.Name) string {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(nil, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "client.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func prodCert(t *testing.T) string {
+	return writeClientCert(t, pkix.Name{
+		CommonName: "test-device",
+		ExtraNames: []pkix.AttributeTypeAndValue{{Type: oidBusinessCategory, Value: "production"}},
+	})
+}
+
+func ciCert(t *testing.T) string {
+	return writeClientCert(t, pkix.Name{CommonName: "test-device"})
+}
+
+func TestDetectDeviceType(t *testing.T) {
+	notPem := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(notPem, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		certPath string
+		want     string
+		wantErr  bool
+	}{
+		{name: "production", certPath: prodCert(t), want: DeviceTypeProd},
+		{name: "ci", certPath: ciCert(t), want: DeviceTypeCi},
+		{name: "not configured", certPath: "", wantErr: true},
+		{name: "missing", certPath: filepath.Join(t.TempDir(), "missing.pem"), wantErr: true},
+		{name: "not PEM", certPath: notPem, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectDeviceType(tt.certPath)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestImportInitialRoot(t *testing.T) {
+	tests := []struct {
+		name        string
+		deviceType  string
+		certPath    func(t *testing.T) string
+		provisioned []string
+		// want is the device type of the imported root, none if empty
+		want string
+	}{
+		{name: "ci", deviceType: DeviceTypeCi, provisioned: []string{DeviceTypeCi, DeviceTypeProd}, want: DeviceTypeCi},
+		{name: "prod", deviceType: DeviceTypeProd, provisioned: []string{DeviceTypeCi, DeviceTypeProd}, want: DeviceTypeProd},
+		{name: "prod not provisioned", deviceType: DeviceTypeProd, provisioned: []string{DeviceTypeCi}},
+		{name: "auto with prod cert", deviceType: DeviceTypeAuto, certPath: prodCert, provisioned: []string{DeviceTypeCi, DeviceTypeProd}, want: DeviceTypeProd},
+		{name: "auto with ci cert", deviceType: DeviceTypeAuto, certPath: ciCert, provisioned: []string{DeviceTypeCi, DeviceTypeProd}, want: DeviceTypeCi},
+		{name: "auto without cert, prod provisioned", deviceType: DeviceTypeAuto, provisioned: []string{DeviceTypeProd}, want: DeviceTypeProd},
+		{name: "auto without cert, both provisioned", deviceType: DeviceTypeAuto, provisioned: []string{DeviceTypeCi, DeviceTypeProd}, want: DeviceTypeCi},
+		{name: "nothing provisioned", deviceType: DeviceTypeAuto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := tufPaths{
+				metadataDir:  filepath.Join(dir, "tuf"),
+				provisionDir: filepath.Join(dir, "provision"),
+				deviceType:   tt.deviceType,
+			}
+			if tt.certPath != nil {
+				paths.clientCertPath = tt.certPath(t)
+			}
+			for _, deviceType := range tt.provisioned {
+				if err := os.MkdirAll(filepath.Join(paths.provisionDir, deviceType), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				for _, version := range []string{"1", "2"} {
+					path := filepath.Join(paths.provisionDir, deviceType, version+".root.json")
+					if err := os.WriteFile(path, []byte(deviceType+version), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			imported, err := importInitialRoot(paths)
+			if tt.want == "" {
+				if GetErrorKind(err) != ErrKindNoInitialRoot {
+					t.Errorf("expected no initial root to be found, got %+v, %v", imported, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported.DeviceType != tt.want || imported.Version != 2 {
+				t.Errorf("expected version 2 of the %s root to be imported, got %+v", tt.want, imported)
+			}
+			data, err := os.ReadFile(filepath.Join(paths.metadataDir, "root.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want+"2" {
+				t.Errorf("expected the %s root to be trusted, got %s", tt.want, data)
+			}
+
+			// an existing trusted root is kept
+			if imported, err = importInitialRoot(paths); imported != nil || err != nil {
+				t.Errorf("expected nothing to be imported again, got %+v, %v", imported, err)
+			}
+		})
+	}
+}
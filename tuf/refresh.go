@@ -0,0 +1,192 @@
+package tuf
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/config"
+	"github.com/theupdateframework/go-tuf/v2/metadata/trustedmetadata"
+	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
+)
+
+// tufSnapshot is the trusted state produced by a single refresh. It must not
+// be modified once it has been published to FioTuf.
+type tufSnapshot struct {
+	updater *updater.Updater
+	tufCfg  *config.UpdaterConfig
+	trusted trustedmetadata.TrustedMetadata
+	targets *targetsView
+	// sources maps each role to the mirror it was fetched from
+	sources map[string]string
+	// raw holds the signed metadata of each role, as verified
+	raw map[string][]byte
+}
+
+func newTufSnapshot(up *updater.Updater, tufCfg *config.UpdaterConfig, targets *targetsView) *tufSnapshot {
+	ret := &tufSnapshot{
+		updater: up,
+		tufCfg:  tufCfg,
+		trusted: up.GetTrustedMetadataSet(),
+		targets: targets,
+		sources: map[string]string{},
+	}
+	if fetcher, ok := tufCfg.Fetcher.(*FioFetcher); ok {
+		ret.sources = fetcher.Sources()
+	}
+	ret.raw = loadRawMetadata(tufCfg.LocalMetadataDir, &ret.trusted, targets)
+	return ret
+}
+
+// refreshCall is a refresh operation in progress. Callers requesting a
+// refresh from the same source while it runs wait for it and share its result.
+type refreshCall struct {
+	localRepoPath string
+	done          chan struct{}
+	err           error
+}
+
+// refreshCoordinator makes sure only one refresh runs at a time
+type refreshCoordinator struct {
+	mu       sync.Mutex
+	inflight *refreshCall
+	// waiters counts the callers waiting for the refresh in flight
+	waiters int
+}
+
+func (rc *refreshCoordinator) do(localRepoPath string, fn func() error) error {
+	rc.mu.Lock()
+	for rc.inflight != nil {
+		call := rc.inflight
+		rc.waiters++
+		rc.mu.Unlock()
+		<-call.done
+		rc.mu.Lock()
+		rc.waiters--
+		if call.localRepoPath == localRepoPath {
+			rc.mu.Unlock()
+			return call.err
+		}
+		// a refresh from another source was running: start our own
+	}
+	call := &refreshCall{localRepoPath: localRepoPath, done: make(chan struct{})}
+	rc.inflight = call
+	rc.mu.Unlock()
+
+	defer func() {
+		rc.mu.Lock()
+		rc.inflight = nil
+		rc.mu.Unlock()
+		close(call.done)
+	}()
+	call.err = fn()
+	return call.err
+}
+
+// waiting returns the number of callers waiting for the refresh in flight
+func (rc *refreshCoordinator) waiting() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.waiters
+}
+
+// wait returns once no refresh is running, or ctx is done
+func (rc *refreshCoordinator) wait(ctx context.Context) error {
+	for {
+		rc.mu.Lock()
+		call := rc.inflight
+		rc.mu.Unlock()
+		if call == nil {
+			return nil
+		}
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// inProgress reports whether a refresh is currently running
+func (rc *refreshCoordinator) inProgress() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.inflight != nil
+}
+
+// RefreshResult is the outcome of a single refresh
+type RefreshResult struct {
+	StartTime time.Time `json:"startTime"`
+	Time      time.Time `json:"time"`
+	// Source is the local repository path, or empty for the device gateway
+	Source        string         `json:"source,omitempty"`
+	ReferenceTime *ReferenceTime `json:"referenceTime,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	ErrorKind     ErrorKind      `json:"errorKind,omitempty"`
+	// Transfer counts the metadata downloaded by the refresh
+	Transfer *TransferStats `json:"transfer,omitempty"`
+	// Sources maps each role downloaded by the refresh to the mirror that
+	// served it
+	Sources map[string]string `json:"sources,omitempty"`
+}
+
+// RefreshStatus reports the last successful and the last failed refresh
+type RefreshStatus struct {
+	InProgress  bool           `json:"inProgress"`
+	LastSuccess *RefreshResult `json:"lastSuccess,omitempty"`
+	LastFailure *RefreshResult `json:"lastFailure,omitempty"`
+	// LastGatewayContact is the last time a response was received from the
+	// device gateway, even an error
+	LastGatewayContact *time.Time `json:"lastGatewayContact,omitempty"`
+	// ImportedRoot is the provisioned root metadata imported when the agent
+	// started, if there was no trusted root yet
+	ImportedRoot *ImportedRoot `json:"importedRoot,omitempty"`
+}
+
+// loadRawMetadata reads the persisted bytes of every trusted role. It must be
+// called right after a refresh, while the local metadata dir matches the
+// trusted set. If it does not, the metadata is serialized again instead.
+func loadRawMetadata(dir string, trusted *trustedmetadata.TrustedMetadata, targets *targetsView) map[string][]byte {
+	ret := map[string][]byte{}
+	add := func(role string, version int64, marshal func() ([]byte, error)) {
+		data, err := os.ReadFile(filepath.Join(dir, url.PathEscape(role)+".json"))
+		if err == nil {
+			var md struct {
+				Signed struct {
+					Version int64 `json:"version"`
+				} `json:"signed"`
+			}
+			if err = json.Unmarshal(data, &md); err == nil && md.Signed.Version == version {
+				ret[role] = data
+				return
+			}
+		}
+		if data, err = marshal(); err != nil {
+			log.Printf("Unable to serialize %s metadata: %s", role, err)
+			return
+		}
+		ret[role] = data
+	}
+
+	add(metadata.ROOT, trusted.Root.Signed.Version, func() ([]byte, error) { return trusted.Root.ToBytes(false) })
+	if md := trusted.Timestamp; md != nil {
+		add(metadata.TIMESTAMP, md.Signed.Version, func() ([]byte, error) { return md.ToBytes(false) })
+	}
+	if md := trusted.Snapshot; md != nil {
+		add(metadata.SNAPSHOT, md.Signed.Version, func() ([]byte, error) { return md.ToBytes(false) })
+	}
+	roles := trusted.Targets
+	if targets != nil {
+		roles = targets.roles
+	}
+	for role, md := range roles {
+		add(role, md.Signed.Version, func() ([]byte, error) { return md.ToBytes(false) })
+	}
+	return ret
+}
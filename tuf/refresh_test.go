@@ -0,0 +1,212 @@
+package tuf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+)
+
+// waitForCallers returns once n callers wait for the refresh in flight
+func waitForCallers(rc *refreshCoordinator, n int) {
+	for rc.waiting() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRefreshCoordinatorSharesSameSource(t *testing.T) {
+	var rc refreshCoordinator
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	errRefresh := errors.New("refresh failed")
+
+	results := make(chan error, 5)
+	go func() {
+		results <- rc.do("/bundle", func() error {
+			calls.Add(1)
+			close(started)
+			<-release
+			return errRefresh
+		})
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		go func() {
+			results <- rc.do("/bundle", func() error {
+				calls.Add(1)
+				return nil
+			})
+		}()
+	}
+	waitForCallers(&rc, 4)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		if err := <-results; !errors.Is(err, errRefresh) {
+			t.Errorf("expected the result of the shared refresh, got %v", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected a single refresh, got %d", n)
+	}
+}
+
+func TestRefreshCoordinatorRunsOtherSources(t *testing.T) {
+	var rc refreshCoordinator
+	var running, maxRunning atomic.Int32
+	var mu sync.Mutex
+	var sources []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	refresh := func(source string, wait bool) func() error {
+		return func() error {
+			if n := running.Add(1); n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			defer running.Add(-1)
+			mu.Lock()
+			sources = append(sources, source)
+			mu.Unlock()
+			if wait {
+				close(started)
+				<-release
+			}
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		rc.do("", refresh("", true))
+	}()
+	<-started
+	for _, source := range []string{"/bundle-a", "/bundle-b"} {
+		go func() {
+			defer wg.Done()
+			if err := rc.do(source, refresh(source, false)); err != nil {
+				t.Errorf("refresh from %s failed: %s", source, err)
+			}
+		}()
+	}
+	waitForCallers(&rc, 2)
+	close(release)
+	wg.Wait()
+
+	if len(sources) != 3 {
+		t.Errorf("expected each source to be refreshed, got %v", sources)
+	}
+	if n := maxRunning.Load(); n != 1 {
+		t.Errorf("expected refreshes to run one at a time, got %d at once", n)
+	}
+	if n := rc.waiting(); n != 0 {
+		t.Errorf("expected no caller left waiting, got %d", n)
+	}
+	if rc.inProgress() {
+		t.Error("expected no refresh in progress")
+	}
+}
+
+// gateway serves a test repository, failing while failing is set
+type gateway struct {
+	repo    *tuftest.Repo
+	failing atomic.Bool
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.failing.Load() {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	g.repo.Handler().ServeHTTP(w, r)
+}
+
+func newTestFioTuf(t *testing.T, tufSettings ...string) (*FioTuf, *gateway) {
+	t.Helper()
+	gw := &gateway{repo: tuftest.NewRepo(t)}
+	server := httptest.NewServer(gw)
+	t.Cleanup(server.Close)
+	fiotuf, err := NewFioTuf(tuftest.NewConfig(t, gw.repo, server.URL, tufSettings...), server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fiotuf, gw
+}
+
+func TestRefreshFailureKeepsSnapshot(t *testing.T) {
+	fiotuf, gw := newTestFioTuf(t)
+	gw.repo.AddTarget("test-1", 1, "test-hwid", "main")
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	root := fiotuf.GetRoot()
+
+	gw.failing.Store(true)
+	gw.repo.AddTarget("test-2", 2, "test-hwid", "main")
+	if err := fiotuf.RefreshTuf(context.Background(), ""); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+
+	if _, ok := fiotuf.GetTargets()["test-1"]; !ok || len(fiotuf.GetTargets()) != 1 {
+		t.Errorf("expected the targets of the previous refresh, got %v", fiotuf.GetTargets())
+	}
+	if fiotuf.GetRoot() != root {
+		t.Error("expected the root of the previous refresh")
+	}
+	status := fiotuf.GetRefreshStatus()
+	if status.LastSuccess == nil || status.LastFailure == nil || status.LastFailure.ErrorKind == "" {
+		t.Errorf("expected the last success and failure to be reported, got %+v", status)
+	}
+}
+
+// TestReadsDuringRefresh is meant to be run with the race detector
+func TestReadsDuringRefresh(t *testing.T) {
+	fiotuf, gw := newTestFioTuf(t)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Millisecond):
+				}
+				for name := range fiotuf.GetDeviceTargets() {
+					if _, err := fiotuf.GetTargetInfo(name); err != nil {
+						t.Errorf("unable to resolve target %s: %s", name, err)
+					}
+				}
+				fiotuf.GetDelegatedTargets()
+				fiotuf.GetRoot()
+				fiotuf.GetRawMetadata("targets")
+				fiotuf.GetMetadataExpiry()
+				fiotuf.GetRefreshStatus()
+			}
+		}()
+	}
+
+	for i := 1; i <= 10; i++ {
+		gw.repo.AddTarget(fmt.Sprintf("test-%d", i), i, "test-hwid", "main")
+		if err := fiotuf.RefreshTuf(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(fiotuf.GetTargets()); n != i {
+			t.Errorf("expected %d targets, got %d", i, n)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
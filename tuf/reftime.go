@@ -0,0 +1,159 @@
+package tuf
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+const (
+	TimeSourceSystem        = "system"
+	TimeSourceLastKnownGood = "last-known-good"
+	TimeSourceGatewayDate   = "gateway-date"
+
+	lastKnownGoodTimeFile = "last_known_good_time"
+)
+
+// minSaneTime is the earliest system time considered valid. Boards without
+// an RTC boot at the epoch until NTP syncs.
+var minSaneTime = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ReferenceTime is the time TUF metadata expiration is checked against
+type ReferenceTime struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+}
+
+// refClock chooses the reference time for a refresh. The system clock is
+// used when sane, that is, after minSaneTime and not before the last known
+// good time. Otherwise the newest of the last known good time and the Date
+// header sent by the device gateway is used. Trusted time never goes back.
+type refClock struct {
+	path          string
+	lastKnownGood time.Time
+
+	mu          sync.Mutex
+	gatewayDate time.Time
+}
+
+func newRefClock(paths tufPaths) *refClock {
+	clock := &refClock{path: filepath.Join(paths.metadataDir, lastKnownGoodTimeFile)}
+	if data, err := os.ReadFile(clock.path); err == nil {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		if err != nil {
+			log.Printf("Ignoring invalid last known good time in %s: %s", clock.path, err)
+		} else {
+			clock.lastKnownGood = t
+		}
+	}
+	// the last known good time is never after the expiration of the trusted
+	// timestamp metadata, a later one would make every refresh fail
+	if expires := readLocalExpiry(paths.metadataDir, metadata.TIMESTAMP); !expires.IsZero() && clock.lastKnownGood.After(expires) {
+		log.Printf("Last known good time %s is after the trusted timestamp expiration, using %s",
+			clock.lastKnownGood.Format(time.RFC3339), expires.Format(time.RFC3339))
+		clock.lastKnownGood = expires
+	}
+	return clock
+}
+
+// readLocalExpiry returns the expiration of a role in the local metadata
+// dir, or the zero time if it cannot be read
+func readLocalExpiry(dir string, role string) time.Time {
+	data, err := os.ReadFile(filepath.Join(dir, role+".json"))
+	if err != nil {
+		return time.Time{}
+	}
+	var md struct {
+		Signed struct {
+			Expires time.Time `json:"expires"`
+		} `json:"signed"`
+	}
+	if err = json.Unmarshal(data, &md); err != nil {
+		return time.Time{}
+	}
+	return md.Signed.Expires
+}
+
+// now returns the reference time to be used at this moment
+func (clock *refClock) now() ReferenceTime {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	system := time.Now().UTC()
+	if system.After(minSaneTime) && !system.Before(clock.lastKnownGood) {
+		return ReferenceTime{Time: system, Source: TimeSourceSystem}
+	}
+	if clock.gatewayDate.After(clock.lastKnownGood) {
+		return ReferenceTime{Time: clock.gatewayDate, Source: TimeSourceGatewayDate}
+	}
+	if !clock.lastKnownGood.IsZero() {
+		return ReferenceTime{Time: clock.lastKnownGood, Source: TimeSourceLastKnownGood}
+	}
+	log.Printf("System time %s does not look valid, but there is no better time source", system.Format(time.RFC3339))
+	return ReferenceTime{Time: system, Source: TimeSourceSystem}
+}
+
+// httpClient returns a copy of client verifying TLS certificates against the
+// reference time. With a system clock set before the validity of the device
+// gateway certificate, the Date header of the gateway could not be received.
+func (clock *refClock) httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		return nil
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return client
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Time = func() time.Time {
+		return clock.now().Time
+	}
+	ret := *client
+	ret.Transport = transport
+	return &ret
+}
+
+// setGatewayDate records the Date header of a device gateway response
+func (clock *refClock) setGatewayDate(date time.Time) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if date.After(clock.gatewayDate) {
+		clock.gatewayDate = date.UTC()
+	}
+}
+
+// persist stores the last known good time after a successful refresh. The
+// Date header of the device gateway is preferred to ref, which may come from
+// a system clock running ahead, and the time is capped at timestampExpires,
+// the expiration of the timestamp metadata just verified. It never goes back.
+func (clock *refClock) persist(ref ReferenceTime, timestampExpires time.Time) error {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	good := ref.Time
+	if !clock.gatewayDate.IsZero() {
+		good = clock.gatewayDate
+	}
+	if good.After(timestampExpires) {
+		good = timestampExpires
+	}
+	if !good.After(clock.lastKnownGood) {
+		return nil
+	}
+	clock.lastKnownGood = good
+	return sotatoml.SafeWrite(clock.path, []byte(good.Format(time.RFC3339)))
+}
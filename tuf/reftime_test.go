@@ -0,0 +1,185 @@
+package tuf
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// newTestClock returns a clock with the given last known good time, and the
+// trusted timestamp metadata expiring at timestampExpires, unless zero
+func newTestClock(t *testing.T, lastKnownGood time.Time, timestampExpires time.Time) *refClock {
+	t.Helper()
+	paths := tufPaths{metadataDir: t.TempDir()}
+	if !lastKnownGood.IsZero() {
+		path := filepath.Join(paths.metadataDir, lastKnownGoodTimeFile)
+		if err := os.WriteFile(path, []byte(lastKnownGood.Format(time.RFC3339)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !timestampExpires.IsZero() {
+		timestamp := metadata.Timestamp(timestampExpires)
+		if err := timestamp.ToFile(filepath.Join(paths.metadataDir, "timestamp.json"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newRefClock(paths)
+}
+
+// setMinSaneTime makes the system clock look valid or not for the test
+func setMinSaneTime(t *testing.T, sane bool) {
+	saved := minSaneTime
+	t.Cleanup(func() { minSaneTime = saved })
+	if !sane {
+		minSaneTime = time.Now().UTC().AddDate(1, 0, 0)
+	}
+}
+
+func TestRefClockNow(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		name          string
+		saneSystem    bool
+		lastKnownGood time.Time
+		gatewayDate   time.Time
+		wantSource    string
+		want          time.Time
+	}{
+		{name: "sane", saneSystem: true, lastKnownGood: now.Add(-time.Hour), wantSource: TimeSourceSystem},
+		{name: "pre-sane without other source", wantSource: TimeSourceSystem},
+		{name: "pre-sane", lastKnownGood: now.Add(-time.Hour), wantSource: TimeSourceLastKnownGood, want: now.Add(-time.Hour)},
+		{name: "pre-sane with gateway date", lastKnownGood: now.Add(-time.Hour), gatewayDate: now.Add(-time.Minute), wantSource: TimeSourceGatewayDate, want: now.Add(-time.Minute)},
+		{name: "pre-sane with older gateway date", lastKnownGood: now.Add(-time.Hour), gatewayDate: now.Add(-2 * time.Hour), wantSource: TimeSourceLastKnownGood, want: now.Add(-time.Hour)},
+		{name: "rolled back", saneSystem: true, lastKnownGood: now.Add(time.Hour), wantSource: TimeSourceLastKnownGood, want: now.Add(time.Hour)},
+		{name: "rolled back with gateway date", saneSystem: true, lastKnownGood: now.Add(time.Hour), gatewayDate: now.Add(2 * time.Hour), wantSource: TimeSourceGatewayDate, want: now.Add(2 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinSaneTime(t, tt.saneSystem)
+			clock := newTestClock(t, tt.lastKnownGood, time.Time{})
+			if !tt.gatewayDate.IsZero() {
+				clock.setGatewayDate(tt.gatewayDate)
+			}
+
+			ref := clock.now()
+			if ref.Source != tt.wantSource {
+				t.Errorf("expected the %s time, got %+v", tt.wantSource, ref)
+			}
+			if !tt.want.IsZero() && !ref.Time.Equal(tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, ref.Time)
+			}
+		})
+	}
+}
+
+func TestRefClockCapsLastKnownGood(t *testing.T) {
+	expires := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second)
+	clock := newTestClock(t, expires.Add(24*time.Hour), expires)
+	if !clock.lastKnownGood.Equal(expires) {
+		t.Errorf("expected the last known good time to be capped at %s, got %s", expires, clock.lastKnownGood)
+	}
+}
+
+func TestRefClockPersist(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	expires := now.Add(24 * time.Hour)
+	tests := []struct {
+		name          string
+		lastKnownGood time.Time
+		gatewayDate   time.Time
+		ref           time.Time
+		want          time.Time
+	}{
+		{name: "reference time", ref: now, want: now},
+		{name: "gateway date preferred", gatewayDate: now.Add(-time.Minute), ref: now, want: now.Add(-time.Minute)},
+		{name: "capped at timestamp expiry", ref: now.Add(48 * time.Hour), want: expires},
+		{name: "never goes back", lastKnownGood: now.Add(time.Hour), ref: now, want: now.Add(time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newTestClock(t, tt.lastKnownGood, time.Time{})
+			if !tt.gatewayDate.IsZero() {
+				clock.setGatewayDate(tt.gatewayDate)
+			}
+			if err := clock.persist(ReferenceTime{Time: tt.ref, Source: TimeSourceSystem}, expires); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := newRefClock(tufPaths{metadataDir: filepath.Dir(clock.path)}).lastKnownGood; !got.Equal(tt.want) {
+				t.Errorf("expected %s to be persisted, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// newFutureTLSServer starts a TLS server whose certificate is only valid
+// from notBefore, and returns a client trusting it
+func newFutureTLSServer(t *testing.T, notBefore time.Time) (*httptest.Server, *http.Client) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-gateway"},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(24 * time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(nil, template, template, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	return server, client
+}
+
+func TestRefClockHttpClient(t *testing.T) {
+	// the system clock is behind the validity of the gateway certificate,
+	// the last known good time is not
+	notBefore := time.Now().UTC().Add(10 * 24 * time.Hour)
+	server, client := newFutureTLSServer(t, notBefore)
+	clock := newTestClock(t, notBefore.Add(time.Hour), time.Time{})
+
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("expected the certificate not to be valid at the system time")
+	}
+	res, err := clock.httpClient(client).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the certificate to be valid at the reference time, got %s", err)
+	}
+	res.Body.Close()
+	if client.Transport.(*http.Transport).TLSClientConfig.Time != nil {
+		t.Error("expected the original client to be left untouched")
+	}
+}
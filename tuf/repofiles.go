@@ -0,0 +1,79 @@
+package tuf
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// GetRepoFile returns a metadata file of the TUF repository layout, like
+// "timestamp.json" or "3.snapshot.json", from the metadata trusted by this
+// device. Only the trusted version of each role is available, except for
+// roots, which are read from the local root store.
+func (fiotuf *FioTuf) GetRepoFile(name string) ([]byte, error) {
+	role, version := parseMetadataPath(name)
+	if role == metadata.ROOT && version > 0 {
+		data, err := fiotuf.GetRootVersion(version)
+		if err != nil {
+			return nil, &Error{Kind: ErrKindNotFound, Err: err}
+		}
+		return data, nil
+	}
+	data, ok := fiotuf.GetRawMetadata(role)
+	if !ok {
+		return nil, &Error{Kind: ErrKindNotFound, Err: fmt.Errorf("no trusted metadata for role %s", role)}
+	}
+	if version > 0 {
+		var md struct {
+			Signed struct {
+				Version int64 `json:"version"`
+			} `json:"signed"`
+		}
+		if err := json.Unmarshal(data, &md); err != nil || md.Signed.Version != version {
+			return nil, &Error{Kind: ErrKindNotFound, Err: fmt.Errorf("version %d of role %s is not trusted", version, role)}
+		}
+	}
+	return data, nil
+}
+
+// GetCachedTargetPath returns the local path of a target file previously
+// downloaded by go-tuf, given its path in the TUF repository layout, which
+// may be prefixed with one of the target hashes
+func (fiotuf *FioTuf) GetCachedTargetPath(remotePath string) (string, error) {
+	dir := fiotuf.getSnapshot().tufCfg.LocalTargetsDir
+	for _, target := range fiotuf.GetTargets() {
+		if !matchesTargetPath(target, remotePath) {
+			continue
+		}
+		path := filepath.Join(dir, url.PathEscape(target.Path))
+		if info, err := os.Stat(path); err != nil || info.Size() != target.Length {
+			break
+		}
+		return path, nil
+	}
+	return "", &Error{Kind: ErrKindNotFound, Err: fmt.Errorf("target file %s is not available", remotePath)}
+}
+
+func matchesTargetPath(target *metadata.TargetFiles, remotePath string) bool {
+	if target.Path == remotePath {
+		return true
+	}
+	base := filepath.Base(target.Path)
+	dir, hasDir := strings.CutSuffix(target.Path, "/"+base)
+	for _, hash := range target.Hashes {
+		name := hex.EncodeToString(hash) + "." + base
+		if hasDir {
+			name = dir + "/" + name
+		}
+		if name == remotePath {
+			return true
+		}
+	}
+	return false
+}
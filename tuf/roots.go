@@ -0,0 +1,172 @@
+package tuf
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// ErrRootNotFound is returned when a root version is not in the local store
+var ErrRootNotFound = errors.New("root version not found")
+
+// rootsDir is where every root version trusted by the device is kept, as
+// <version>.root.json, since go-tuf only keeps the latest one
+func rootsDir(paths tufPaths) string {
+	return filepath.Join(paths.metadataDir, "roots")
+}
+
+// saveRoot adds a root version to the local root store
+func saveRoot(paths tufPaths, version int64, data []byte) error {
+	dir := rootsDir(paths)
+	path := filepath.Join(dir, strconv.FormatInt(version, 10)+".root.json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return sotatoml.SafeWrite(path, data)
+}
+
+// readRoot reads a root version from the local root store
+func readRoot(paths tufPaths, version int64) ([]byte, error) {
+	path := filepath.Join(rootsDir(paths), strconv.FormatInt(version, 10)+".root.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %d", ErrRootNotFound, version)
+	}
+	return data, err
+}
+
+// saveRootChain adds to the local root store the downloaded root versions
+// that chain from trustedRoot. Each version must be signed by a threshold of
+// keys of both the previous version and itself, as go-tuf requires, so
+// versions that did not make it into the trusted metadata are not saved.
+func saveRootChain(paths tufPaths, trustedRoot []byte, downloaded [][]byte) error {
+	cur, err := metadata.Root().FromBytes(trustedRoot)
+	if err != nil {
+		return err
+	}
+	for _, data := range downloaded {
+		next, err := metadata.Root().FromBytes(data)
+		if err != nil || next.Signed.Version != cur.Signed.Version+1 {
+			continue
+		}
+		if err = cur.VerifyDelegate(metadata.ROOT, next); err != nil {
+			continue
+		}
+		if err = next.VerifyDelegate(metadata.ROOT, next); err != nil {
+			continue
+		}
+		if err = saveRoot(paths, next.Signed.Version, data); err != nil {
+			return err
+		}
+		cur = next
+	}
+	return nil
+}
+
+// RootInfo describes a root metadata version
+type RootInfo struct {
+	Version int64                   `json:"version"`
+	Expires time.Time               `json:"expires"`
+	Current bool                    `json:"current"`
+	Roles   map[string]RootRoleInfo `json:"roles"`
+}
+
+// RootRoleInfo lists the keys trusted for a top-level role by a root version
+type RootRoleInfo struct {
+	Threshold int           `json:"threshold"`
+	Keys      []RootKeyInfo `json:"keys"`
+}
+
+type RootKeyInfo struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Scheme string `json:"scheme"`
+}
+
+func newRootInfo(md *metadata.Metadata[metadata.RootType]) RootInfo {
+	info := RootInfo{
+		Version: md.Signed.Version,
+		Expires: md.Signed.Expires,
+		Roles:   map[string]RootRoleInfo{},
+	}
+	for name, role := range md.Signed.Roles {
+		roleInfo := RootRoleInfo{Threshold: role.Threshold, Keys: []RootKeyInfo{}}
+		for _, id := range role.KeyIDs {
+			keyInfo := RootKeyInfo{ID: id}
+			if key, ok := md.Signed.Keys[id]; ok {
+				keyInfo.Type = key.Type
+				keyInfo.Scheme = key.Scheme
+			}
+			roleInfo.Keys = append(roleInfo.Keys, keyInfo)
+		}
+		info.Roles[name] = roleInfo
+	}
+	return info
+}
+
+// GetRootHistory lists the root versions kept in the local root store, along
+// with the currently trusted root, oldest first. Devices provisioned before
+// the root store existed only have the root versions verified since then.
+func GetRootHistory(config *sotatoml.AppConfig) ([]RootInfo, error) {
+	paths := getTufPaths(config)
+	current, err := metadata.Root().FromFile(filepath.Join(paths.metadataDir, "root.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(rootsDir(paths), "*.root.json"))
+	if err != nil {
+		return nil, err
+	}
+	ret := []RootInfo{}
+	for _, file := range files {
+		version, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".root.json"), 10, 64)
+		if err != nil || version == current.Signed.Version {
+			continue
+		}
+		md, err := metadata.Root().FromFile(file)
+		if err != nil {
+			log.Printf("Ignoring invalid root metadata %s: %s", file, err)
+			continue
+		}
+		ret = append(ret, newRootInfo(md))
+	}
+	info := newRootInfo(current)
+	info.Current = true
+	ret = append(ret, info)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	return ret, nil
+}
+
+// SortedRoles returns the role names of a root version, top-level roles
+// first, in the order they are used by a TUF client
+func (info RootInfo) SortedRoles() []string {
+	order := []string{metadata.ROOT, metadata.TIMESTAMP, metadata.SNAPSHOT, metadata.TARGETS}
+	var ret []string
+	for _, name := range order {
+		if _, ok := info.Roles[name]; ok {
+			ret = append(ret, name)
+		}
+	}
+	var others []string
+	for name := range info.Roles {
+		if !slices.Contains(order, name) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	return append(ret, others...)
+}
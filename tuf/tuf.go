@@ -1,180 +1,347 @@
 package tuf
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
-	"github.com/foundriesio/fioconfig/transport"
 	"github.com/go-logr/stdr"
 	"github.com/theupdateframework/go-tuf/v2/metadata"
 	"github.com/theupdateframework/go-tuf/v2/metadata/config"
 	"github.com/theupdateframework/go-tuf/v2/metadata/updater"
 )
 
-type FioFetcher struct {
-	client  *http.Client
-	tag     string
-	repoUrl string
-}
-
 type FioTuf struct {
-	config     *sotatoml.AppConfig
-	client     *http.Client
-	fioUpdater *updater.Updater
+	config       *sotatoml.AppConfig
+	client       *http.Client
+	importedRoot *ImportedRoot
+
+	// mu protects snapshot, which is replaced as a whole after each
+	// successful refresh and never modified afterwards
+	mu        sync.RWMutex
+	snapshot  *tufSnapshot
+	status    RefreshStatus
+	listeners []func(RefreshResult)
+
+	progressListeners []func(RefreshProgress)
+
+	refresh refreshCoordinator
 }
 
 func NewFioTuf(config *sotatoml.AppConfig, client *http.Client) (*FioTuf, error) {
-	up, err := newFioUpdater(config, client, "")
+	imported, err := importInitialRoot(getTufPaths(config))
+	if err != nil {
+		return nil, err
+	}
+
+	up, tufCfg, err := newFioUpdater(config, client, getTufPaths(config), "")
 	if err != nil {
 		return nil, err
 	}
 
 	ret := FioTuf{
-		config:     config,
-		client:     client,
-		fioUpdater: up,
+		config:       config,
+		client:       client,
+		importedRoot: imported,
+		snapshot:     newTufSnapshot(up, tufCfg, nil),
 	}
 
 	return &ret, nil
 }
 
-func (fiotuf *FioTuf) RefreshTuf(localRepoPath string) error {
+// RefreshTuf updates the trusted metadata from the device gateway, or from
+// localRepoPath if set. Concurrent calls for the same source are coalesced
+// into a single refresh, which stops downloading once the ctx of the caller
+// that started it is done. The trusted metadata exposed by FioTuf is only
+// replaced if the refresh fully succeeds. Failures are returned as an *Error.
+func (fiotuf *FioTuf) RefreshTuf(ctx context.Context, localRepoPath string) error {
+	return fiotuf.refresh.do(localRepoPath, func() error {
+		result := &RefreshResult{Source: localRepoPath, StartTime: time.Now().UTC()}
+		err := classifyError(fiotuf.doRefresh(ctx, localRepoPath, result))
+		fiotuf.recordRefresh(result, err)
+		return err
+	})
+}
+
+// AddRefreshListener registers a function to be called after every refresh
+// attempt, successful or not
+func (fiotuf *FioTuf) AddRefreshListener(fn func(RefreshResult)) {
+	fiotuf.mu.Lock()
+	defer fiotuf.mu.Unlock()
+	fiotuf.listeners = append(fiotuf.listeners, fn)
+}
+
+// IsRefreshing tells if a refresh is currently running
+func (fiotuf *FioTuf) IsRefreshing() bool {
+	return fiotuf.refresh.inProgress()
+}
+
+// WaitIdle waits for the running refresh, if any, to finish. It returns an
+// error if ctx is done first.
+func (fiotuf *FioTuf) WaitIdle(ctx context.Context) error {
+	return fiotuf.refresh.wait(ctx)
+}
+
+// GetRefreshStatus returns the outcome of the last refreshes
+func (fiotuf *FioTuf) GetRefreshStatus() RefreshStatus {
+	fiotuf.mu.RLock()
+	status := fiotuf.status
+	fiotuf.mu.RUnlock()
+	status.InProgress = fiotuf.IsRefreshing()
+	status.ImportedRoot = fiotuf.GetImportedRoot()
+	return status
+}
+
+func (fiotuf *FioTuf) recordRefresh(result *RefreshResult, err error) {
+	result.Time = time.Now().UTC()
+	fiotuf.mu.Lock()
+	if err != nil {
+		result.Error = err.Error()
+		result.ErrorKind = GetErrorKind(err)
+		fiotuf.status.LastFailure = result
+	} else {
+		fiotuf.status.LastSuccess = result
+	}
+	listeners := slices.Clone(fiotuf.listeners)
+	fiotuf.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(*result)
+	}
+}
+
+// doRefresh runs a refresh, filling result with its details
+func (fiotuf *FioTuf) doRefresh(ctx context.Context, localRepoPath string, result *RefreshResult) error {
 	metadata.SetLogger(stdr.New(log.New(os.Stdout, "", log.LstdFlags)))
 
-	up, err := newFioUpdater(fiotuf.config, fiotuf.client, localRepoPath)
+	if localRepoPath != "" {
+		// a missing local repository would otherwise be reported as missing metadata
+		repoPath := strings.TrimPrefix(localRepoPath, "file://")
+		if _, err := os.Stat(repoPath); err != nil {
+			return &Error{Kind: ErrKindBundleUnreadable, Err: err}
+		}
+		if !isTufRepo(repoPath) && isTufRepo(BundleRepoPath(repoPath)) {
+			return &Error{Kind: ErrKindBundleUnreadable, Err: fmt.Errorf("%s is an offline bundle, refresh from its TUF repository %s", repoPath, BundleRepoPath(repoPath))}
+		}
+	}
+
+	up, tufCfg, err := newFioUpdater(fiotuf.config, fiotuf.client, getTufPaths(fiotuf.config), localRepoPath)
 	if err != nil {
 		return err
 	}
-	fiotuf.fioUpdater = up
+
+	// go-tuf only exposes the reference time for tests, but it is the only
+	// way to check expiration against something else than the system clock
+	clock := newRefClock(getTufPaths(fiotuf.config))
+	ref := clock.now()
+	result.ReferenceTime = &ref
+	up.UnsafeSetRefTime(ref.Time)
+	if fetcher, ok := tufCfg.Fetcher.(*FioFetcher); ok {
+		fetcher.ctx = ctx
+		if ref.Source != TimeSourceSystem {
+			fetcher.client = clock.httpClient(fetcher.client)
+		}
+		fetcher.onGatewayResponse = func(res *http.Response) {
+			fiotuf.mu.Lock()
+			now := time.Now().UTC()
+			fiotuf.status.LastGatewayContact = &now
+			fiotuf.mu.Unlock()
+			if date, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+				clock.setGatewayDate(date)
+				ref = clock.now()
+				up.UnsafeSetRefTime(ref.Time)
+			}
+		}
+		fetcher.onFetch = func(role string, bytesDownloaded int64) {
+			fiotuf.notifyProgress(RefreshProgress{
+				Source:          localRepoPath,
+				Phase:           phaseOf(role),
+				Role:            role,
+				BytesDownloaded: bytesDownloaded,
+			})
+		}
+		defer func() {
+			stats := fetcher.Stats()
+			result.Transfer = &stats
+			result.Sources = fetcher.Sources()
+			if err := fetcher.SaveCache(); err != nil {
+				log.Println("failed to save HTTP cache: ", err)
+			}
+		}()
+	}
+	if ref.Source != TimeSourceSystem {
+		log.Printf("Using %s time %s as TUF reference time", ref.Source, ref.Time.Format(time.RFC3339))
+	}
 
 	// try to build the top-level metadata
-	err = up.Refresh()
+	err = refreshUpdater(up)
+	if fetcher, ok := tufCfg.Fetcher.(*FioFetcher); ok {
+		// intermediate root versions are verified by go-tuf but never stored,
+		// keep them even if a later step fails
+		if err := saveRootChain(getTufPaths(fiotuf.config), tufCfg.LocalTrustedRoot, fetcher.Roots()); err != nil {
+			log.Println("failed to save root metadata to the local root store: ", err)
+		}
+	}
 	if err != nil {
 		log.Println("failed to refresh trusted metadata: ", err)
 		return err
 	}
+
+	// walk the delegations tree, so that delegated targets are also visible
+	view, err := loadTargetsView(up, tufCfg)
+	if err != nil {
+		log.Println("failed to load delegated targets metadata: ", err)
+		return err
+	}
+
+	if err = clock.persist(ref, up.GetTrustedMetadataSet().Timestamp.Signed.Expires); err != nil {
+		log.Println("failed to persist last known good time: ", err)
+	}
+
+	snapshot := newTufSnapshot(up, tufCfg, view)
+	if err = saveRoot(getTufPaths(fiotuf.config), snapshot.trusted.Root.Signed.Version, snapshot.raw[metadata.ROOT]); err != nil {
+		log.Println("failed to save root metadata to the local root store: ", err)
+	}
+
+	fiotuf.mu.Lock()
+	fiotuf.snapshot = snapshot
+	fiotuf.mu.Unlock()
 	log.Println("TUF refresh successful")
-	// for name := range up.GetTopLevelTargets() {
-	// 	log.Println("target name " + name)
-	// }
 	return nil
 }
 
-func (fiotuf *FioTuf) GetTargets() map[string]*metadata.TargetFiles {
-	return fiotuf.fioUpdater.GetTopLevelTargets()
+// refreshUpdater runs the go-tuf refresh. go-tuf panics on some malformed
+// metadata, which must not take the whole agent down.
+func refreshUpdater(up *updater.Updater) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Kind: ErrKindInvalidMetadata, Err: fmt.Errorf("invalid metadata: %v", r)}
+		}
+	}()
+	return up.Refresh()
 }
 
-func (fiotuf *FioTuf) GetRoot() *metadata.Metadata[metadata.RootType] {
-	return fiotuf.fioUpdater.GetTrustedMetadataSet().Root
+func (fiotuf *FioTuf) getSnapshot() *tufSnapshot {
+	fiotuf.mu.RLock()
+	defer fiotuf.mu.RUnlock()
+	return fiotuf.snapshot
 }
 
-// DownloadFile downloads a file from urlPath, errors out if it failed,
-// its length is larger than maxLength or the timeout is reached.
-func (d *FioFetcher) DownloadFile(urlPath string, maxLength int64, timeout time.Duration) ([]byte, error) {
-	if strings.HasPrefix(urlPath, "file://") {
-		return readLocalFile(urlPath[len("file://"):])
-	} else {
-		return readRemoteFile(d, urlPath, maxLength)
+// GetTargets returns the merged list of targets provided by the top-level
+// targets role and all its delegated roles
+func (fiotuf *FioTuf) GetTargets() map[string]*metadata.TargetFiles {
+	ret := map[string]*metadata.TargetFiles{}
+	snapshot := fiotuf.getSnapshot()
+	if snapshot.targets == nil {
+		return ret
 	}
-}
-
-func readLocalFile(filePath string) ([]byte, error) {
-	log.Println("Reading local file:", filePath)
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, &metadata.ErrDownloadHTTP{StatusCode: 404, URL: "file://" + filePath}
+	for name, t := range snapshot.targets.targets {
+		ret[name] = t.Target
 	}
-	return data, nil
+	return ret
 }
 
-func readRemoteFile(d *FioFetcher, urlPath string, maxLength int64) ([]byte, error) {
-	log.Println("Fetching remote file: " + urlPath)
-	headers := make(map[string]string)
-	headers["x-ats-tags"] = d.tag
-	res, err := transport.HttpGet(d.client, urlPath, headers)
+// GetDeviceTargets returns the targets matching the tags and hardware ID of
+// this device, which are the candidates for an update. Tags are checked
+// on the device as well, so that metadata from an offline bundle, which is
+// not filtered by the device gateway, yields the same targets.
+func (fiotuf *FioTuf) GetDeviceTargets() map[string]*metadata.TargetFiles {
+	targets := FilterByHardwareId(fiotuf.GetTargets(), GetHardwareId(fiotuf.config))
+	return FilterByTags(targets, GetTags(fiotuf.config))
+}
 
-	if err != nil {
-		return nil, err
+// GetDelegatedTargets returns the same list as GetTargets, annotated with
+// the role each target was resolved from
+func (fiotuf *FioTuf) GetDelegatedTargets() map[string]*DelegatedTarget {
+	ret := map[string]*DelegatedTarget{}
+	snapshot := fiotuf.getSnapshot()
+	if snapshot.targets == nil {
+		return ret
 	}
+	for name, t := range snapshot.targets.targets {
+		ret[name] = t
+	}
+	return ret
+}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, &metadata.ErrDownloadHTTP{StatusCode: res.StatusCode, URL: urlPath}
+// GetTargetInfo looks up a single target through the delegations tree
+func (fiotuf *FioTuf) GetTargetInfo(name string) (*DelegatedTarget, error) {
+	snapshot := fiotuf.getSnapshot()
+	if snapshot.targets == nil {
+		return nil, fmt.Errorf("TUF metadata has not been refreshed yet")
 	}
+	return snapshot.targets.resolve(name)
+}
 
-	var length int64
-	// Get content length from header (might not be accurate, -1 or not set).
-	if header := res.Header.Get("Content-Length"); header != "" {
-		length, err = strconv.ParseInt(header, 10, 0)
-		if err != nil {
-			return nil, err
-		}
-		// Error if the reported size is greater than what is expected.
-		if length > maxLength {
-			return nil, &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("download failed for %s, length %d is larger than expected %d", urlPath, length, maxLength)}
-		}
+// GetTargetsVersion returns the version of the trusted top-level targets
+// metadata, 0 before it is first loaded
+func (fiotuf *FioTuf) GetTargetsVersion() int64 {
+	targets, ok := fiotuf.getSnapshot().trusted.Targets[metadata.TARGETS]
+	if !ok {
+		return 0
 	}
-	// // Although the size has been checked above, use a LimitReader in case
-	// // the reported size is inaccurate, or size is -1 which indicates an
-	// // unknown length. We read maxLength + 1 in order to check if the read data
-	// // surpassed our set limit.
-	// data, err := io.ReadAll(io.LimitReader(res.Body, maxLength+1))
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// Error if the reported size is greater than what is expected.
-	length = int64(len(res.Body))
-	if length > maxLength {
-		return nil, &metadata.ErrDownloadLengthMismatch{Msg: fmt.Sprintf("download failed for %s, length %d is larger than expected %d", urlPath, length, maxLength)}
+	return targets.Signed.Version
+}
+
+func (fiotuf *FioTuf) GetRoot() *metadata.Metadata[metadata.RootType] {
+	return fiotuf.getSnapshot().trusted.Root
+}
+
+// GetRawMetadata returns the signed metadata of a trusted role, exactly as
+// it was verified
+func (fiotuf *FioTuf) GetRawMetadata(role string) ([]byte, bool) {
+	data, ok := fiotuf.getSnapshot().raw[role]
+	return data, ok
+}
+
+// GetRootVersion returns a root metadata version from the local root store
+func (fiotuf *FioTuf) GetRootVersion(version int64) ([]byte, error) {
+	snapshot := fiotuf.getSnapshot()
+	if snapshot.trusted.Root.Signed.Version == version {
+		return snapshot.raw[metadata.ROOT], nil
 	}
+	return readRoot(getTufPaths(fiotuf.config), version)
+}
 
-	return res.Body, nil
+// GetRootHistory lists the root versions walked through by this device
+func (fiotuf *FioTuf) GetRootHistory() ([]RootInfo, error) {
+	return GetRootHistory(fiotuf.config)
 }
 
-func getTufCfg(client *http.Client, repoUrl string, tag string) (*config.UpdaterConfig, error) {
-	// TODO: do not hardcode paths:
-	localMetadataDir := "/var/sota/tuf/"
-	provPath := "/usr/lib/sota/tuf/"
+// GetMetadataSources returns the mirror each role was fetched from during
+// the last successful refresh. Roles loaded from the local metadata dir are
+// not listed.
+func (fiotuf *FioTuf) GetMetadataSources() map[string]string {
+	return maps.Clone(fiotuf.getSnapshot().sources)
+}
 
-	rootPath := filepath.Join(localMetadataDir, "root.json")
-	if _, err := os.Stat(rootPath); errors.Is(err, os.ErrNotExist) {
-		log.Printf("%s does not exist. Trying to import initial root metadata\n", rootPath)
-		deviceType := "ci" // or "prod"
-		existingRootPath := ""
-		for i := 1; i < 100; i++ {
-			importRootPath := filepath.Join(provPath, deviceType, strconv.Itoa(i)+".root.json")
-			if _, err := os.Stat(importRootPath); errors.Is(err, os.ErrNotExist) {
-				log.Printf("%s does not exist\n", importRootPath)
-				break
-			} else {
-				existingRootPath = importRootPath
-			}
-		}
+// GetImportedRoot returns the provisioned root metadata imported when this
+// instance was created, or nil if a trusted root was already in place
+func (fiotuf *FioTuf) GetImportedRoot() *ImportedRoot {
+	return fiotuf.importedRoot
+}
 
-		if existingRootPath != "" {
-			log.Printf("Importing %s", existingRootPath)
-			rootPath = existingRootPath
-		} else {
-			msg := "unable to find initial root metadata"
-			log.Println(msg)
-			return nil, errors.New(msg)
-		}
-	}
+func getTufCfg(fetcher *FioFetcher, paths tufPaths) (*config.UpdaterConfig, error) {
+	localMetadataDir := paths.metadataDir
+	rootPath := filepath.Join(localMetadataDir, "root.json")
 
 	rootBytes, err := os.ReadFile(rootPath)
 	if err != nil {
 		log.Println("os.ReadFile error")
-		return nil, err
+		return nil, &Error{Kind: ErrKindNoInitialRoot, Err: err}
 	}
 
 	// create updater configuration
+	repoUrl := fetcher.repoUrl
 	cfg, err := config.New(repoUrl, rootBytes) // default config
 	if err != nil {
 		log.Println("config.New(repoUrl, error")
@@ -184,44 +351,41 @@ func getTufCfg(client *http.Client, repoUrl string, tag string) (*config.Updater
 	cfg.LocalTargetsDir = filepath.Join(localMetadataDir, "download")
 	cfg.RemoteTargetsURL = repoUrl
 	cfg.PrefixTargetsWithHash = true
-	cfg.Fetcher = &FioFetcher{
-		client:  client,
-		tag:     tag,
-		repoUrl: repoUrl,
-	}
+	cfg.Fetcher = fetcher
 	return cfg, nil
 }
 
-func newFioUpdater(config *sotatoml.AppConfig, client *http.Client, localRepoPath string) (*updater.Updater, error) {
-	repoUrl := ""
+func newFioUpdater(config *sotatoml.AppConfig, client *http.Client, paths tufPaths, localRepoPath string) (*updater.Updater, *config.UpdaterConfig, error) {
+	var mirrors []string
 	if localRepoPath == "" {
-		repoUrl = config.GetDefault("tls.server", "https://ota-lite.foundries.io:8443") + "/repo"
+		mirrors = getMirrors(config)
+		log.Println("Refreshing TUF metadata from device gateway")
 	} else {
-		if strings.HasPrefix(localRepoPath, "file://") {
-			repoUrl = localRepoPath
-		} else {
+		repoUrl := localRepoPath
+		if !strings.HasPrefix(localRepoPath, "file://") {
 			repoUrl = "file://" + localRepoPath
 		}
+		mirrors = []string{repoUrl}
+		log.Println("Refreshing TUF metadata from", repoUrl)
 	}
 
+	fetcher := newFioFetcher(client, config.Get("pacman.tags"), mirrors, getFetchRetries(config))
+	fetcher.timeout = getFetchTimeout(config)
 	if localRepoPath == "" {
-		log.Println("Refreshing TUF metadata from device gateway")
-	} else {
-		log.Println("Refreshing TUF metadata from", repoUrl)
+		fetcher.gatewayUrl = gatewayRepoUrl(config)
+		fetcher.cache = loadHttpCache(paths)
 	}
-
-	tag := config.Get("pacman.tags")
-	tufCfg, err := getTufCfg(client, repoUrl, tag)
+	tufCfg, err := getTufCfg(fetcher, paths)
 	if err != nil {
 		log.Println("failed to create Config instance: ", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// create a new Updater instance
 	up, err := updater.New(tufCfg)
 	if err != nil {
 		log.Println("failed to create Updater instance: ", err)
-		return nil, err
+		return nil, nil, err
 	}
-	return up, err
+	return up, tufCfg, err
 }
@@ -0,0 +1,96 @@
+package updateclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foundriesio/composeapp/pkg/compose"
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fiotuf/targets"
+)
+
+// ExportTargetApps copies the blobs of the current target's compose apps
+// from the local app store to the apps directory of an offline bundle. It
+// fails if any app or blob is missing, as the bundle could not be installed.
+func ExportTargetApps(config *sotatoml.AppConfig, bundlePath string) error {
+	dbFilePath := path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db"))
+	target, err := targets.GetCurrentTarget(dbFilePath)
+	if err != nil || target == nil {
+		return fmt.Errorf("unable to get current target: %v", err)
+	}
+	appsUris, err := GetAppsUris(target)
+	if err != nil {
+		return err
+	}
+	composeConfig, err := getComposeConfig(config)
+	if err != nil {
+		return err
+	}
+	apps, err := compose.ListApps(context.Background(), composeConfig)
+	if err != nil {
+		return fmt.Errorf("error listing apps: %v", err)
+	}
+
+	blobsDir := compose.GetBlobsRootFor(filepath.Join(bundlePath, "apps"))
+	if err = os.MkdirAll(blobsDir, 0o755); err != nil {
+		return err
+	}
+	var exported []string
+	var missing []string
+	for _, app := range apps {
+		uri := app.Ref().Spec.Locator + "@" + app.Ref().Digest.String()
+		if !slices.Contains(appsUris, uri) {
+			continue
+		}
+		log.Println("Exporting app", uri)
+		err = (*compose.TreeNode)(app.Tree()).Walk(func(node *compose.TreeNode, depth int) error {
+			name := node.Descriptor.Digest.Encoded()
+			err := copyBlob(filepath.Join(composeConfig.GetBlobsRoot(), name), filepath.Join(blobsDir, name))
+			if errors.Is(err, os.ErrNotExist) {
+				// image layers may have been pruned once loaded into docker
+				log.Printf("Blob %s of app %s is not in the app store", node.Descriptor.Digest, uri)
+				missing = append(missing, node.Descriptor.Digest.String())
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error exporting app %s: %v", uri, err)
+		}
+		exported = append(exported, uri)
+	}
+	for _, uri := range appsUris {
+		if !slices.Contains(exported, uri) {
+			return fmt.Errorf("app %s of target %s is not in the app store, the bundle is incomplete", uri, target.Path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d blobs of target %s are not in the app store, the bundle is incomplete: %s", len(missing), target.Path, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func copyBlob(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
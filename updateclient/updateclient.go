@@ -3,6 +3,7 @@ package updateclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/metrics"
 	"github.com/foundriesio/fiotuf/targets"
 	"github.com/foundriesio/fiotuf/tuf"
 	"github.com/theupdateframework/go-tuf/v2/metadata"
@@ -83,6 +85,9 @@ type (
 		Runner        update.Runner
 		Resuming      bool
 		CorrelationId string
+
+		// OnProgress, if set, is called as the target is downloaded and installed
+		OnProgress func(UpdateProgress)
 	}
 )
 
@@ -101,76 +106,170 @@ func InitializeDatabase(dbFilePath string) error {
 	return nil
 }
 
-// Runs check + update (if needed) once. May become a loop in the future
-func RunUpdateClient(srcDir string, cfgDirs []string) error {
-	var configPaths []string
-	if len(cfgDirs) > 0 {
-		configPaths = cfgDirs
-	} else {
-		configPaths = sotatoml.DEF_CONFIG_ORDER
+// UpdateClient checks for updates and applies them. It may share its FioTuf
+// instance and database with the HTTP agent running in the same process.
+type UpdateClient struct {
+	config     *sotatoml.AppConfig
+	client     *http.Client
+	fiotuf     *tuf.FioTuf
+	dbFilePath string
+	// reportTuf is set when the update client owns fiotuf, and so reports
+	// refresh failures and expiring metadata itself
+	reportTuf bool
+	// noCompatibleVersion is the targets version a NoCompatibleTarget event
+	// was last saved for
+	noCompatibleVersion int64
+
+	// OnProgress, if set, is called as targets are downloaded and installed
+	OnProgress func(UpdateProgress)
+}
+
+// NewUpdateClient initializes the database and returns an update client. If
+// fiotuf is nil, a FioTuf instance is created, otherwise the caller is
+// expected to report its refresh failures and expiring metadata.
+func NewUpdateClient(config *sotatoml.AppConfig, client *http.Client, fiotuf *tuf.FioTuf) (*UpdateClient, error) {
+	uc := &UpdateClient{
+		config:     config,
+		client:     client,
+		fiotuf:     fiotuf,
+		dbFilePath: path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db")),
+	}
+	err := InitializeDatabase(uc.dbFilePath)
+	if err != nil {
+		log.Println("Error initializing database", err)
+		return nil, err
 	}
-	config, err := sotatoml.NewAppConfig(configPaths)
+	if uc.fiotuf != nil {
+		return uc, nil
+	}
+
+	uc.fiotuf, err = tuf.NewFioTuf(config, client)
 	if err != nil {
-		log.Println("ERROR - unable to decode sota.toml:", err)
-		os.Exit(1)
+		log.Println("Error creating fiotuf instance", err)
+		return nil, err
 	}
+	uc.reportTuf = true
+	warner := tuf.NewExpiryWarner(func(e tuf.RoleExpiry) {
+		evt := events.NewEvent(events.MetadataExpiring, e.String(), nil, "", "", 0)
+		if err := events.SaveEvent(uc.dbFilePath, &evt[0]); err != nil {
+			log.Println("Error saving metadata expiry event", err)
+		}
+	})
+	uc.fiotuf.AddRefreshListener(func(tuf.RefreshResult) {
+		warner.Check(uc.fiotuf.GetMetadataExpiry())
+	})
+	return uc, nil
+}
 
+// Run refreshes the TUF metadata, from localRepoPath if set, selects the
+// target to run, applies it if needed, then reports the apps state and
+// flushes events. If ctx is done during the refresh or the update, it is
+// interrupted and ErrInterrupted is returned right away; the update is
+// resumed and reported by the next run.
+func (uc *UpdateClient) Run(ctx context.Context, localRepoPath string) error {
 	updateContext := &UpdateContext{
-		DbFilePath: path.Join(config.GetDefault("storage.path", "/var/sota"), config.GetDefault("storage.sqldb_path", "sql.db")),
+		Context:    ctx,
+		DbFilePath: uc.dbFilePath,
+		OnProgress: uc.OnProgress,
+	}
+
+	err := uc.fiotuf.RefreshTuf(ctx, localRepoPath)
+	if ierr := interrupted(updateContext); err != nil && ierr != nil {
+		log.Println(ierr)
+		return ierr
 	}
-	err = InitializeDatabase(updateContext.DbFilePath)
 	if err != nil {
-		log.Println("Error initializing database", err)
+		log.Println("Error refreshing TUF", err)
+		if uc.reportTuf {
+			evt := events.NewEvent(events.MetadataUpdateFailed, err.Error(), targets.BoolPointer(false), "", "", 0)
+			evt[0].Event.ErrorKind = string(tuf.GetErrorKind(err))
+			if err := events.SaveEvent(updateContext.DbFilePath, &evt[0]); err != nil {
+				log.Println("Error saving metadata update failure event", err)
+			}
+		}
+		flushEvents(uc.config, uc.client, updateContext)
 		return err
 	}
 
-	client := transport.CreateClient(config)
-	fiotuf, err := tuf.NewFioTuf(config, client)
+	tufTargets := uc.fiotuf.GetTargets()
+	err = GetTargetToInstall(updateContext, uc.config, tufTargets)
+	if errors.Is(err, ErrNoCompatibleTarget) {
+		uc.reportNoCompatibleTarget(err)
+	}
 	if err != nil {
-		log.Println("Error creating fiotuf instance", err)
+		flushEvents(uc.config, uc.client, updateContext)
+		return fmt.Errorf("error getting target to install %v", err)
+	}
+
+	_, err = PerformUpdate(updateContext)
+	if errors.Is(err, ErrInterrupted) {
+		// reporting is left to the next run, so that it does not delay
+		// the shutdown
+		log.Println(err)
 		return err
+	} else if err != nil {
+		log.Println("Error updating to target:", err)
 	}
 
-	var localRepoPath string
-	if srcDir == "" {
-		localRepoPath = ""
+	ReportAppsStates(uc.config, uc.client, updateContext)
+	flushEvents(uc.config, uc.client, updateContext)
+	return err
+}
+
+// reportNoCompatibleTarget saves a NoCompatibleTarget event once per version
+// of the targets metadata, rather than on every check of the update daemon
+func (uc *UpdateClient) reportNoCompatibleTarget(err error) {
+	version := uc.fiotuf.GetTargetsVersion()
+	if version == uc.noCompatibleVersion {
+		return
+	}
+	evt := events.NewEvent(events.NoCompatibleTarget, err.Error(), targets.BoolPointer(false), "", "", 0)
+	if err := events.SaveEvent(uc.dbFilePath, &evt[0]); err != nil {
+		log.Println("Error saving no compatible target event", err)
+		return
+	}
+	uc.noCompatibleVersion = version
+}
+
+// Runs check + update (if needed) once, see StartUpdateDaemon in the internal
+// package to run it in a loop.
+// If ctx is done during the update, it is interrupted and resumed by the next run.
+func RunUpdateClient(ctx context.Context, srcDir string, cfgDirs []string) error {
+	var configPaths []string
+	if len(cfgDirs) > 0 {
+		configPaths = cfgDirs
 	} else {
-		localRepoPath = path.Join(srcDir, "repo")
+		configPaths = sotatoml.DEF_CONFIG_ORDER
 	}
-	err = fiotuf.RefreshTuf(localRepoPath)
+	config, err := sotatoml.NewAppConfig(configPaths)
 	if err != nil {
-		log.Println("Error refreshing TUF", err)
-		return err
+		log.Println("ERROR - unable to decode sota.toml:", err)
+		os.Exit(1)
 	}
 
-	tufTargets := fiotuf.GetTargets()
-	err = GetTargetToInstall(updateContext, config, tufTargets)
+	uc, err := NewUpdateClient(config, transport.CreateClient(config), nil)
 	if err != nil {
-		return fmt.Errorf("error getting target to install %v", err)
+		return err
 	}
 
-	// log.Println("GetTargetToInstall", updateContext.Target, updateContext.AppsToInstall, updateContext.AppsToUninstall)
-	if updateContext != nil {
-		_, err := PerformUpdate(updateContext)
-		// if doRollback {
-		// 	log.Println("Rolling back", err)
-		// 	err = Rollback(updateContext)
-		// 	if err != nil {
-		// 		log.Println("Error rolling back", err)
-		// 		return err
-		// 	}
-		// }
-		if err != nil {
-			log.Println("Error updating to target:", err)
-		}
+	var localRepoPath string
+	if srcDir == "" {
+		localRepoPath = ""
+	} else {
+		localRepoPath = tuf.BundleRepoPath(srcDir)
 	}
+	err = uc.Run(ctx, localRepoPath)
+	if errors.Is(err, ErrInterrupted) {
+		// not a failure, the update is resumed by the next run
+		return nil
+	}
+	return err
+}
 
-	ReportAppsStates(config, client, updateContext)
-
+func flushEvents(config *sotatoml.AppConfig, client *http.Client, updateContext *UpdateContext) {
 	eventsUrl := config.GetDefault("tls.server", "https://ota-lite.foundries.io:8443") + "/events"
 	log.Println("Flushing events")
 	events.FlushEvents(updateContext.DbFilePath, client, eventsUrl)
-	return err
 }
 
 func ReportAppsStates(config *sotatoml.AppConfig, client *http.Client, updateContext *UpdateContext) error {
@@ -375,6 +474,10 @@ func FillAndCheckAppsList(updateContext *UpdateContext) error {
 	return nil
 }
 
+// ErrNoCompatibleTarget is returned when none of the targets matches the
+// hardware ID of the device
+var ErrNoCompatibleTarget = errors.New("no compatible target")
+
 // Returns information about the apps to install and to remove, as long as the corresponding target
 // No update operation is performed at this point. Not even apps stopping
 func GetTargetToInstall(updateContext *UpdateContext, config *sotatoml.AppConfig, tufTargets map[string]*metadata.TargetFiles) error {
@@ -397,6 +500,26 @@ func GetTargetToInstall(updateContext *UpdateContext, config *sotatoml.AppConfig
 		fmt.Println("Version set to", versionInt)
 	}
 
+	hwid := tuf.GetHardwareId(config)
+	if hwid != "" {
+		compatible := tuf.FilterByHardwareId(tufTargets, hwid)
+		if len(compatible) == 0 && len(tufTargets) > 0 {
+			err = fmt.Errorf("%w: none of the %d targets is compatible with hardware ID %s", ErrNoCompatibleTarget, len(tufTargets), hwid)
+			log.Println(err)
+			return err
+		}
+		log.Printf("%d of %d targets are compatible with hardware ID %s", len(compatible), len(tufTargets), hwid)
+		tufTargets = compatible
+	}
+
+	tags := tuf.GetTags(config)
+	if len(tags) > 0 {
+		// metadata from offline bundles is not filtered by the device gateway
+		tagged := tuf.FilterByTags(tufTargets, tags)
+		log.Printf("%d of %d targets match tags %v", len(tagged), len(tufTargets), tags)
+		tufTargets = tagged
+	}
+
 	candidateTarget, _ := selectTarget(tufTargets, versionInt)
 	if candidateTarget == nil {
 		log.Println("No target found for version", versionInt)
@@ -414,7 +537,9 @@ func GetTargetToInstall(updateContext *UpdateContext, config *sotatoml.AppConfig
 
 	updateContext.Target = candidateTarget
 	updateContext.CurrentTarget = currentTarget
-	updateContext.Context = context.Background()
+	if updateContext.Context == nil {
+		updateContext.Context = context.Background()
+	}
 
 	apps := config.GetDefault("pacman.compose_apps", "-")
 	if apps != "-" {
@@ -465,30 +590,74 @@ func UpdateToTarget(updateContext *UpdateContext) (bool, error) {
 
 	err := InitUpdate(updateContext)
 	if err != nil {
-		return false, fmt.Errorf("error initializing update for target: %v", err)
+		return false, fmt.Errorf("error initializing update for target: %w", err)
 	}
+	return applyUpdate(updateContext)
+}
 
+// applyUpdate pulls, installs and starts the target of the update set up by
+// InitUpdate. It stops with ErrInterrupted before each phase once the update
+// context is done, and if a phase is interrupted.
+func applyUpdate(updateContext *UpdateContext) (bool, error) {
 	// Pull
+	err := interrupted(updateContext)
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
 	err = PullTarget(updateContext)
+	if errors.Is(err, ErrInterrupted) {
+		// not a failure of the phase, it is resumed by the next run
+		return false, err
+	}
+	metrics.ObserveUpdatePhase(metrics.PhasePull, start, err)
 	if err != nil {
-		return false, fmt.Errorf("error pulling target: %v", err)
+		return false, fmt.Errorf("error pulling target: %w", err)
 	}
 
 	// Install
+	if err = interrupted(updateContext); err != nil {
+		return false, err
+	}
+	start = time.Now()
 	err = InstallTarget(updateContext)
+	if errors.Is(err, ErrInterrupted) {
+		return false, err
+	}
+	metrics.ObserveUpdatePhase(metrics.PhaseInstall, start, err)
 	if err != nil {
-		return false, fmt.Errorf("error installing target: %v", err)
+		return false, fmt.Errorf("error installing target: %w", err)
 	}
 
 	// Run
+	if err = interrupted(updateContext); err != nil {
+		return false, err
+	}
+	start = time.Now()
 	doRollback, err := StartTarget(updateContext)
+	if errors.Is(err, ErrInterrupted) {
+		return false, err
+	}
+	metrics.ObserveUpdatePhase(metrics.PhaseStart, start, err)
 	if err != nil {
-		return doRollback, fmt.Errorf("error running target: %v", err)
+		return doRollback, fmt.Errorf("error running target: %w", err)
 	}
 
 	return false, nil
 }
 
+// ErrInterrupted is returned when an update is stopped because its context
+// is done. The composeapp update is left as is, so that InitUpdate resumes it.
+var ErrInterrupted = errors.New("update interrupted, it will be resumed on next run")
+
+// interrupted returns an ErrInterrupted error if the update context is done
+func interrupted(updateContext *UpdateContext) error {
+	if err := updateContext.Context.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInterrupted, err)
+	}
+	return nil
+}
+
 func StopAndRemoveApps(updateContext *UpdateContext) error {
 	if len(updateContext.AppsToUninstall) == 0 {
 		log.Println("No apps to uninstall")
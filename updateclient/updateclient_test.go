@@ -0,0 +1,237 @@
+package updateclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/foundriesio/composeapp/pkg/compose"
+	v1 "github.com/foundriesio/composeapp/pkg/compose/v1"
+	"github.com/foundriesio/composeapp/pkg/update"
+	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/internal/tuftest"
+	"github.com/foundriesio/fiotuf/targets"
+	"github.com/theupdateframework/go-tuf/v2/metadata"
+)
+
+// gateway serves a test repository and records the events it receives
+type gateway struct {
+	repo   *tuftest.Repo
+	mu     sync.Mutex
+	events []events.DgUpdateEvent
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/events" {
+		g.repo.Handler().ServeHTTP(w, r)
+		return
+	}
+	var evts []events.DgUpdateEvent
+	if err := json.NewDecoder(r.Body).Decode(&evts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	g.events = append(g.events, evts...)
+	g.mu.Unlock()
+}
+
+func (g *gateway) count(eventType events.EventTypeValue) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, evt := range g.events {
+		if evt.EventType.Id == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+func newTestUpdateClient(t *testing.T) (*UpdateClient, *gateway) {
+	t.Helper()
+	gw := &gateway{repo: tuftest.NewRepo(t)}
+	server := httptest.NewServer(gw)
+	t.Cleanup(server.Close)
+	uc, err := NewUpdateClient(tuftest.NewConfig(t, gw.repo, server.URL), server.Client(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uc, gw
+}
+
+func TestNoCompatibleTargetReportedOncePerVersion(t *testing.T) {
+	uc, gw := newTestUpdateClient(t)
+	gw.repo.AddTarget("other-1", 1, "other-hwid", "main")
+
+	for i := 0; i < 3; i++ {
+		if err := uc.Run(context.Background(), ""); err == nil {
+			t.Fatal("expected no target to be found")
+		}
+	}
+	if n := gw.count(events.NoCompatibleTarget); n != 1 {
+		t.Errorf("expected a single event for the same targets, got %d", n)
+	}
+
+	gw.repo.AddTarget("other-2", 2, "other-hwid", "main")
+	if err := uc.Run(context.Background(), ""); err == nil {
+		t.Fatal("expected no target to be found")
+	}
+	if n := gw.count(events.NoCompatibleTarget); n != 2 {
+		t.Errorf("expected a new event for new targets, got %d events", n)
+	}
+}
+
+// interruptingRunner is an update.Runner that records the phases it runs,
+// and cancels the update context when it reaches the interruptAt phase
+type interruptingRunner struct {
+	state       update.State
+	interruptAt string
+	cancel      context.CancelFunc
+	phases      []string
+}
+
+func (r *interruptingRunner) run(ctx context.Context, phase string, done update.State) error {
+	r.phases = append(r.phases, phase)
+	if phase == r.interruptAt {
+		r.cancel()
+		return ctx.Err()
+	}
+	r.state = done
+	return nil
+}
+
+func (r *interruptingRunner) Status() update.Update {
+	return update.Update{State: r.state, Progress: 100}
+}
+
+func (r *interruptingRunner) Init(ctx context.Context, appURIs []string, options ...update.InitOption) error {
+	return r.run(ctx, "init", update.StateInitialized)
+}
+
+func (r *interruptingRunner) Fetch(ctx context.Context, options ...compose.FetchOption) error {
+	return r.run(ctx, "fetch", update.StateFetched)
+}
+
+func (r *interruptingRunner) Install(ctx context.Context, options ...compose.InstallOption) error {
+	return r.run(ctx, "install", update.StateInstalled)
+}
+
+func (r *interruptingRunner) Start(ctx context.Context) error {
+	return r.run(ctx, "start", update.StateStarted)
+}
+
+func (r *interruptingRunner) Cancel(ctx context.Context) error {
+	return r.run(ctx, "cancel", update.StateCanceled)
+}
+
+func (r *interruptingRunner) Complete(ctx context.Context, options ...update.CompleteOpt) error {
+	return r.run(ctx, "complete", update.StateCompleted)
+}
+
+func newTestUpdateContext(t *testing.T, ctx context.Context, runner update.Runner) *UpdateContext {
+	t.Helper()
+	dir := t.TempDir()
+	dbFilePath := filepath.Join(dir, "sql.db")
+	if err := InitializeDatabase(dbFilePath); err != nil {
+		t.Fatal(err)
+	}
+	composeConfig, err := v1.NewDefaultConfig(
+		v1.WithStoreRoot(filepath.Join(dir, "reset-apps")),
+		v1.WithComposeRoot(filepath.Join(dir, "compose-apps")),
+		v1.WithUpdateDB(filepath.Join(dir, "updates.db")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := metadata.TargetFile().FromBytes("test-2", []byte("test-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := json.RawMessage(`{"version": "2"}`)
+	target.Custom = &custom
+	return &UpdateContext{
+		DbFilePath:    dbFilePath,
+		Target:        target,
+		CurrentTarget: target,
+		Context:       ctx,
+		ComposeConfig: composeConfig,
+		Runner:        runner,
+		CorrelationId: "2-1",
+	}
+}
+
+func TestApplyUpdateInterrupted(t *testing.T) {
+	tests := []struct {
+		phase string
+		want  []string
+	}{
+		{phase: "fetch", want: []string{"fetch"}},
+		{phase: "install", want: []string{"fetch", "install"}},
+		{phase: "start", want: []string{"fetch", "install", "start"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.phase, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runner := &interruptingRunner{state: update.StateInitialized, interruptAt: tt.phase, cancel: cancel}
+			updateContext := newTestUpdateContext(t, ctx, runner)
+
+			doRollback, err := applyUpdate(updateContext)
+			if !errors.Is(err, ErrInterrupted) || doRollback {
+				t.Fatalf("expected the update to be interrupted without rollback, got %v, %v", doRollback, err)
+			}
+			// the update is left for the next run to resume, not cancelled
+			if !slices.Equal(runner.phases, tt.want) {
+				t.Errorf("expected the phases %v to run, got %v", tt.want, runner.phases)
+			}
+			evts, _, err := events.GetEvents(updateContext.DbFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, evt := range evts {
+				if evt.Event.Success != nil && !*evt.Event.Success {
+					t.Errorf("expected no failure to be reported, got %+v", evt)
+				}
+			}
+			if failing, err := targets.IsFailingTarget(updateContext.DbFilePath, "test-2"); err != nil || failing {
+				t.Errorf("expected the target not to be marked as failing, got %v, %v", failing, err)
+			}
+		})
+	}
+}
+
+func TestApplyUpdateInterruptedBeforePhase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &interruptingRunner{state: update.StateInitialized}
+	updateContext := newTestUpdateContext(t, ctx, runner)
+	cancel()
+
+	if _, err := applyUpdate(updateContext); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected the update to be interrupted, got %v", err)
+	}
+	if len(runner.phases) != 0 {
+		t.Errorf("expected no phase to run, got %v", runner.phases)
+	}
+}
+
+func TestRunInterruptedDuringRefresh(t *testing.T) {
+	uc, gw := newTestUpdateClient(t)
+	gw.repo.AddTarget("test-1", 1, "test-hwid", "main")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := uc.Run(ctx, ""); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("expected the run to be interrupted, got %v", err)
+	}
+	if n := len(gw.events); n != 0 {
+		t.Errorf("expected no event to be sent once interrupted, got %d", n)
+	}
+}
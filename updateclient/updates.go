@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/foundriesio/fiotuf/events"
+	"github.com/foundriesio/fiotuf/metrics"
 	"github.com/foundriesio/fiotuf/targets"
 
 	_ "modernc.org/sqlite"
@@ -18,6 +19,33 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
+// UpdateStage is the step of an update reported by UpdateProgress
+type UpdateStage string
+
+const (
+	StageDownload UpdateStage = "download"
+	StageInstall  UpdateStage = "install"
+)
+
+// UpdateProgress reports the bytes processed so far by an update. During
+// installation, it covers the image layer being loaded.
+type UpdateProgress struct {
+	Target  string      `json:"target"`
+	Stage   UpdateStage `json:"stage"`
+	App     string      `json:"app,omitempty"`
+	Image   string      `json:"image,omitempty"`
+	Layer   string      `json:"layer,omitempty"`
+	Current int64       `json:"current"`
+	Total   int64       `json:"total"`
+}
+
+func reportProgress(updateContext *UpdateContext, progress UpdateProgress) {
+	if updateContext.OnProgress != nil {
+		progress.Target = updateContext.Target.Path
+		updateContext.OnProgress(progress)
+	}
+}
+
 func InitUpdate(updateContext *UpdateContext) error {
 	updateRunner, err := update.GetCurrentUpdate(updateContext.ComposeConfig)
 	var correlationId string
@@ -136,10 +164,18 @@ func PullTarget(updateContext *UpdateContext) error {
 				if err := bar.Set64(status.CurrentBytes); err != nil {
 					log.Printf("Error setting progress bar: %s\n", err.Error())
 				}
+				reportProgress(updateContext, UpdateProgress{
+					Stage:   StageDownload,
+					Current: status.CurrentBytes,
+					Total:   updateStatus.TotalBlobsBytes,
+				})
 			}),
 			compose.WithProgressPollInterval(200)}
 
 		err = updateContext.Runner.Fetch(updateContext.Context, fetchOptions...)
+		if ierr := interrupted(updateContext); err != nil && ierr != nil {
+			return ierr
+		}
 		if err != nil {
 			err := GenAndSaveEvent(updateContext, events.DownloadCompleted, err.Error(), targets.BoolPointer(false))
 			return fmt.Errorf("error pulling target: %v", err)
@@ -168,10 +204,20 @@ type progressRendererCtx struct {
 	curLayerID string
 }
 
-func getProgressRenderer() compose.InstallProgressFunc {
+func getProgressRenderer(updateContext *UpdateContext) compose.InstallProgressFunc {
 	ctx := &progressRendererCtx{}
 
 	return func(p *compose.InstallProgress) {
+		if p.AppInstallState == compose.AppInstallStateImagesLoading && p.ImageLoadState == compose.ImageLoadStateLayerLoading {
+			reportProgress(updateContext, UpdateProgress{
+				Stage:   StageInstall,
+				App:     p.AppID,
+				Image:   p.ImageID,
+				Layer:   p.ID,
+				Current: p.Current,
+				Total:   p.Total,
+			})
+		}
 		switch p.AppInstallState {
 		case compose.AppInstallStateComposeInstalling:
 			{
@@ -255,10 +301,13 @@ func InstallTarget(updateContext *UpdateContext) error {
 
 	if invokeComposeUpdate {
 		installOptions := []compose.InstallOption{
-			compose.WithInstallProgress(getProgressRenderer())}
+			compose.WithInstallProgress(getProgressRenderer(updateContext))}
 
 		compose.StopApps(updateContext.Context, updateContext.ComposeConfig, updateContext.AppsToUninstall)
 		err = updateContext.Runner.Install(updateContext.Context, installOptions...)
+		if ierr := interrupted(updateContext); err != nil && ierr != nil {
+			return ierr
+		}
 	}
 	if err != nil {
 		err := GenAndSaveEvent(updateContext, events.DownloadCompleted, err.Error(), targets.BoolPointer(false))
@@ -302,6 +351,10 @@ func StartTarget(updateContext *UpdateContext) (bool, error) {
 
 	if invokeComposeUpdate {
 		err = updateContext.Runner.Start(updateContext.Context)
+		if ierr := interrupted(updateContext); err != nil && ierr != nil {
+			// not a failure of the target, do not roll back
+			return false, ierr
+		}
 		if err != nil {
 			log.Println("error on starting target", err)
 			err := GenAndSaveEvent(updateContext, events.InstallationCompleted, err.Error(), targets.BoolPointer(false))
@@ -346,6 +399,7 @@ func StartTarget(updateContext *UpdateContext) (bool, error) {
 
 func rollback(updateContext *UpdateContext) error {
 	log.Println("Rolling back to target", updateContext.CurrentTarget.Path)
+	metrics.IncRollbacks()
 
 	if updateContext.Runner != nil {
 